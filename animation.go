@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/thraxil/resize"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// a resized animated gif. Anything that only wants one
+// image (or doesn't know about gifs) just gets the first frame.
+type animation struct {
+	image.Image
+	gif *gif.GIF
+}
+
+// how many frames a gif has, found by skipping over the blocks
+// in it without decoding any of them. Anything that isn't a gif
+// has none.
+func gifFrameCount(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:3]) != "GIF" {
+		return 0, nil
+	}
+	if header[10]&0x80 != 0 {
+		// global colour table
+		if _, err := br.Discard(3 << (header[10]&7 + 1)); err != nil {
+			return 0, err
+		}
+	}
+	frames := 0
+	for {
+		block, err := br.ReadByte()
+		if err != nil {
+			return frames, err
+		}
+		switch block {
+		case 0x21: // extension: a label, then sub-blocks
+			if _, err := br.Discard(1); err != nil {
+				return frames, err
+			}
+		case 0x2c: // image descriptor
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return frames, err
+			}
+			if descriptor[8]&0x80 != 0 {
+				// local colour table
+				if _, err := br.Discard(3 << (descriptor[8]&7 + 1)); err != nil {
+					return frames, err
+				}
+			}
+			// LZW minimum code size, then the data in sub-blocks
+			if _, err := br.Discard(1); err != nil {
+				return frames, err
+			}
+			frames++
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return frames, errors.New(fmt.Sprintf("bad gif block %#x", block))
+		}
+		// skip the sub-blocks, up to the empty one that ends them
+		for {
+			size, err := br.ReadByte()
+			if err != nil {
+				return frames, err
+			}
+			if size == 0 {
+				break
+			}
+			if _, err := br.Discard(int(size)); err != nil {
+				return frames, err
+			}
+		}
+	}
+}
+
+// each frame of an animation ends up as a whole canvas worth of
+// pixels once it's coalesced, so a gif counts as that many images
+// of its size against MaxPixels. Otherwise thousands of tiny
+// frames on a big canvas get past the limit and then take up
+// gigabytes. Needs to run before anything decodes the frames.
+func (l ImageLimits) checkFrames(r io.Reader, cfg image.Config) error {
+	if l.MaxPixels < 1 {
+		return nil
+	}
+	frames, err := gifFrameCount(r)
+	if err != nil && frames == 0 {
+		return nil
+	}
+	pixels := int64(frames) * int64(cfg.Width) * int64(cfg.Height)
+	if pixels > l.MaxPixels {
+		return uploadError{413, fmt.Sprintf("animation is %d frames of %dx%d pixels; the limit is %d pixels in all",
+			frames, cfg.Width, cfg.Height, l.MaxPixels)}
+	}
+	return nil
+}
+
+// what each frame of g actually looks like on screen. Frames
+// after the first are often just the bits that changed, drawn
+// over what was left by the frame before.
+func coalesce(g *gif.GIF) []*image.RGBA {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	frames := make([]*image.RGBA, 0, len(g.Image))
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		snapshot := image.NewRGBA(bounds)
+		copy(snapshot.Pix, canvas.Pix)
+		frames = append(frames, snapshot)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+// back to a palette for gif, sticking with the colours
+// the frame had, plus transparency if there's room for it
+func toPaletted(img image.Image, p color.Palette) *image.Paletted {
+	pal := append(color.Palette{}, p...)
+	transparent := false
+	for _, c := range pal {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent = true
+		}
+	}
+	if !transparent && len(pal) < 256 {
+		pal = append(pal, color.RGBA{})
+	}
+	out := image.NewPaletted(img.Bounds(), pal)
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out
+}
+
+// every frame gets resized, keeping the timing and how many
+// times it loops. The frames come out whole, so each one
+// clears the last away rather than drawing over it.
+func resizeAnimation(g *gif.GIF, s *resize.SizeSpec) *animation {
+	out := &gif.GIF{LoopCount: g.LoopCount}
+	var first image.Image
+	for i, frame := range coalesce(g) {
+		scaled := scaleImage(frame, s)
+		if first == nil {
+			first = scaled
+		}
+		out.Image = append(out.Image, toPaletted(scaled, g.Image[i].Palette))
+		var delay int
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+	return &animation{first, out}
+}
+
+// g cut down to its first frame, so it's no longer animated
+func justFirstFrame(g *gif.GIF) *gif.GIF {
+	return &gif.GIF{Image: g.Image[:1], Disposal: g.Disposal[:1], Config: g.Config}
+}
+
+// what the first frame of g looks like, without
+// bothering with the rest
+func firstFrameOf(g *gif.GIF) *image.RGBA {
+	return coalesce(justFirstFrame(g))[0]
+}
+
+func gifencode(out io.Writer, in image.Image) error {
+	if a, ok := in.(*animation); ok {
+		return gif.EncodeAll(out, a.gif)
+	}
+	return gif.Encode(out, in, nil)
+}
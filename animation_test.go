@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"github.com/thraxil/resize"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http/httptest"
+	"testing"
+)
+
+var animationPalette = color.Palette{
+	color.RGBA{255, 0, 0, 255},
+	color.RGBA{0, 255, 0, 255},
+	color.RGBA{0, 0, 255, 255},
+}
+
+// three frames on a 20x10 canvas: red all over, then a green
+// square drawn over the top left, then a blue one in the
+// bottom right, which the green one should still be next to
+func animatedGIF() []byte {
+	full := image.NewPaletted(image.Rect(0, 0, 20, 10), animationPalette)
+	green := image.NewPaletted(image.Rect(0, 0, 10, 5), animationPalette)
+	blue := image.NewPaletted(image.Rect(10, 5, 20, 10), animationPalette)
+	for i := range green.Pix {
+		green.Pix[i] = 1
+		blue.Pix[i] = 2
+	}
+	g := &gif.GIF{
+		Image:     []*image.Paletted{full, green, blue},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalNone},
+		LoopCount: 2,
+		Config:    image.Config{ColorModel: animationPalette, Width: 20, Height: 10},
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, g)
+	return buf.Bytes()
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
+
+func Test_coalesce(t *testing.T) {
+	g, err := gif.DecodeAll(bytes.NewReader(animatedGIF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := coalesce(g)
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(frames))
+	}
+	last := frames[2]
+	if last.Bounds() != image.Rect(0, 0, 20, 10) {
+		t.Error("frames should cover the whole canvas")
+	}
+	if !sameColor(last.At(2, 2), animationPalette[1]) || !sameColor(last.At(15, 7), animationPalette[2]) ||
+		!sameColor(last.At(15, 2), animationPalette[0]) {
+		t.Error("later frames should be drawn over the earlier ones")
+	}
+	if !sameColor(frames[1].At(15, 7), animationPalette[0]) {
+		t.Error("frames shouldn't show anything from later on")
+	}
+
+	g.Disposal[1] = gif.DisposalBackground
+	if _, _, _, a := coalesce(g)[2].At(2, 2).RGBA(); a != 0 {
+		t.Error("disposing to the background should clear it")
+	}
+	g.Disposal[1] = gif.DisposalPrevious
+	if !sameColor(coalesce(g)[2].At(2, 2), animationPalette[0]) {
+		t.Error("disposing to previous should put back what was there")
+	}
+}
+
+func Test_resizeAnimated(t *testing.T) {
+	s := ConfigData{Writeable: true}.MyConfig()
+	st, ri := resizeTestStore(t, "gif", animatedGIF())
+	img, err := resizeNative(ri, st, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 10, 5) {
+		t.Errorf("first frame came out %v", img.Bounds())
+	}
+	var buf bytes.Buffer
+	if err := gifencode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 || g.LoopCount != 2 {
+		t.Fatalf("lost frames or the loop count: %d frames, loop %d", len(g.Image), g.LoopCount)
+	}
+	for i, d := range []int{10, 20, 30} {
+		if g.Delay[i] != d {
+			t.Errorf("frame %d delay %d, not %d", i, g.Delay[i], d)
+		}
+		if g.Image[i].Bounds() != image.Rect(0, 0, 10, 5) {
+			t.Errorf("frame %d is %v", i, g.Image[i].Bounds())
+		}
+	}
+	if !sameColor(g.Image[2].At(1, 1), animationPalette[1]) || !sameColor(g.Image[2].At(8, 4), animationPalette[2]) {
+		t.Error("resized frames should still have everything drawn before them")
+	}
+
+	ri.Size = resize.MakeSizeSpec("4s")
+	img, _ = resizeNative(ri, st, &s)
+	if a, ok := img.(*animation); !ok || a.gif.Image[1].Bounds() != image.Rect(0, 0, 4, 4) {
+		t.Error("squares should crop every frame")
+	}
+}
+
+func Test_ServeImageHandlerGIF(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	ctx.Cfg.Writeable = true
+	ctx.Ch = SharedChannels{ResizeQueue: make(chan ResizeRequest)}
+	go ResizeWorker(ctx.Ch.ResizeQueue, DummyLogger{}, &ctx.Cfg, ctx.Store)
+	defer close(ctx.Ch.ResizeQueue)
+
+	img, err := ctx.ingest(bytes.NewReader(animatedGIF()), "", ImageMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := func(url string) int {
+		w := httptest.NewRecorder()
+		ServeImageHandler(w, httptest.NewRequest("GET", url, nil), ctx)
+		if w.Code != 200 {
+			t.Fatalf("%s failed: %d %s", url, w.Code, w.Body.String())
+		}
+		g, err := gif.DecodeAll(w.Body)
+		if err != nil {
+			t.Fatalf("%s isn't a gif: %s", url, err)
+		}
+		return len(g.Image)
+	}
+	base := "/image/" + img.Hash.String()
+	if frames(base+"/10w/image.gif") != 3 {
+		t.Error("resized animation should have kept its frames")
+	}
+	if frames(base+"/10w/image.gif?static=true") != 1 {
+		t.Error("should only have had the first frame")
+	}
+	if frames(base+"/full/image.gif?static=true") != 1 {
+		t.Error("should only have had the first frame of the original")
+	}
+
+	// the first frame is made once, and kept as a derivative
+	// of its own, next to the animation rather than over it
+	still := &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("10w"), Extension: ".gif", Static: true}
+	if _, err := ctx.Store.Stat(still); err != nil {
+		t.Fatalf("static frame wasn't stored: %s", err)
+	}
+	if frames(base+"/10w/image.gif") != 3 {
+		t.Error("the static frame shouldn't have replaced the animation")
+	}
+	marker := &bytes.Buffer{}
+	gif.Encode(marker, image.NewPaletted(image.Rect(0, 0, 7, 7), animationPalette), nil)
+	ctx.Store.Put(still, bytes.NewReader(marker.Bytes()))
+	w := httptest.NewRecorder()
+	ServeImageHandler(w, httptest.NewRequest("GET", base+"/10w/image.gif?static=true", nil), ctx)
+	if !bytes.Equal(w.Body.Bytes(), marker.Bytes()) {
+		t.Error("second request should have been served from the store")
+	}
+
+	w = httptest.NewRecorder()
+	ServeImageHandler(w, httptest.NewRequest("GET", base+"/10w/image.jpeg?static=true", nil), ctx)
+	if w.Code != 301 || w.Header().Get("Location") != base+"/10w/image.jpg?static=true" {
+		t.Error("redirects should keep the query string")
+	}
+}
+
+// a decompression bomb: a small file, but thousands of frames
+// that each become a whole canvas once coalesced
+func manyFrameGIF(frames, width, height int) []byte {
+	g := &gif.GIF{Config: image.Config{ColorModel: animationPalette, Width: width, Height: height}}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), animationPalette))
+		g.Delay = append(g.Delay, 0)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, g)
+	return buf.Bytes()
+}
+
+func Test_gifFrameCount(t *testing.T) {
+	for _, c := range []struct {
+		data   []byte
+		frames int
+	}{
+		{animatedGIF(), 3},
+		{encodedTestImage("gif", 5, 5), 1},
+		{manyFrameGIF(2000, 100, 100), 2000},
+		{encodedTestImage("png", 5, 5), 0},
+	} {
+		frames, err := gifFrameCount(bytes.NewReader(c.data))
+		if err != nil || frames != c.frames {
+			t.Errorf("expected %d frames, got %d (%v)", c.frames, frames, err)
+		}
+	}
+}
+
+func Test_manyFrameGIFLimits(t *testing.T) {
+	bomb := manyFrameGIF(2000, 100, 100)
+	limits := ImageLimits{MaxPixels: 1000000}
+	if _, err := ingestImage(NewMemoryStore(), bytes.NewReader(bomb), "", "", limits); err == nil {
+		t.Error("2000 frames of 100x100 is over a million pixels, shouldn't be taken")
+	} else if ue, ok := err.(uploadError); !ok || ue.Status != 413 {
+		t.Errorf("should be a 413: %v", err)
+	}
+	if _, err := ingestImage(NewMemoryStore(), bytes.NewReader(animatedGIF()), "", "", limits); err != nil {
+		t.Errorf("a normal animation should still be fine: %v", err)
+	}
+
+	// one that was let in before the limits were tightened
+	s := ConfigData{Writeable: true, ImageMagickConvertPath: "/nonexistent/convert", MaxImagePixels: 1000000}.MyConfig()
+	st, ri := resizeTestStore(t, "gif", bomb)
+	result := resizeImage(ri, st, DummyLogger{}, &s)
+	if ue, ok := result.Err.(uploadError); result.Success || !ok || ue.Status != 413 {
+		t.Errorf("resizing it should be a 413, not %v", result.Err)
+	}
+}
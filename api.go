@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JSON API for programmatic clients. Unlike the HTML form
+// handlers, everything here (errors included) comes back as JSON.
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func jsonResponse(w http.ResponseWriter, v interface{}, code int) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func jsonError(w http.ResponseWriter, message string, code int) {
+	jsonResponse(w, apiError{message}, code)
+}
+
+// the key can come either as a query parameter
+// or in an X-Upload-Key header
+func apiKey(r *http.Request) string {
+	key := r.Header.Get("X-Upload-Key")
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	return key
+}
+
+func (ctx Context) apiKeyValid(r *http.Request) bool {
+	if !ctx.Cfg.KeyRequired() {
+		return true
+	}
+	return ctx.Cfg.ValidKey(apiKey(r))
+}
+
+// /api/images
+func ImagesAPIHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	switch r.Method {
+	case "PUT":
+		ctx.apiUpload(w, r)
+	case "POST":
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "image/") {
+			jsonError(w, "POST body must be an image/* content type", 415)
+			return
+		}
+		ctx.apiUpload(w, r)
+	default:
+		w.Header().Set("Allow", "PUT, POST")
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+// the request body is the raw image
+func (ctx Context) apiUpload(w http.ResponseWriter, r *http.Request) {
+	if !ctx.apiKeyValid(r) {
+		jsonError(w, "invalid upload key", 403)
+		return
+	}
+	if err := ctx.limitBody(w, r); err != nil {
+		ctx.uploadFailed(w, err)
+		return
+	}
+	defer r.Body.Close()
+	// ingest needs to go over it twice
+	f, _, err := spoolToTemp(r.Body, ctx.Cfg.MaxUploadBytes)
+	if err != nil {
+		ctx.uploadFailed(w, bodyError(err, "could not read request body"))
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	q := r.URL.Query()
+	id, err := ctx.upload(f, uploadMetadata(q.Get("filename"), apiKey(r)), q.Get("size_hints"),
+		q.Get("near_duplicates"), apiKey(r))
+	if err != nil {
+		ctx.uploadFailed(w, err)
+		return
+	}
+	w.Header().Set("Location", id.FullUrl)
+	jsonResponse(w, id, 201)
+}
+
+// /api/images/$hash
+func ImageAPIHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	hash := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/images/"), "/")
+	ahash, err := HashFromString(hash, "")
+	if err != nil {
+		jsonError(w, "invalid hash", 404)
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		ctx.apiDelete(w, r, ahash)
+	default:
+		w.Header().Set("Allow", "DELETE")
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+type DeleteResponse struct {
+	Hash   string   `json:"hash"`
+	Nodes  []string `json:"nodes"`
+	Failed []string `json:"failed"`
+}
+
+// removes the image everywhere it could be. Nodes that are down
+// right now will hear about it through gossip later.
+func (ctx Context) apiDelete(w http.ResponseWriter, r *http.Request, ahash *Hash) {
+	// deletion is destructive enough that it is never open to all
+	if !ctx.Cfg.KeyRequired() {
+		jsonError(w, "deletion requires upload keys to be configured", 403)
+		return
+	}
+	if !ctx.apiKeyValid(r) {
+		jsonError(w, "invalid upload key", 403)
+		return
+	}
+	t := ctx.Cluster.NewTombstone(ahash.String(), time.Now())
+	err := ctx.purge(t)
+	if err != nil {
+		jsonError(w, "could not delete local copy", 500)
+		return
+	}
+	resp := DeleteResponse{
+		Hash:   ahash.String(),
+		Nodes:  []string{ctx.Cluster.Myself.Nickname},
+		Failed: []string{},
+	}
+	for _, n := range ctx.Cluster.ReadOrder(ahash.String()) {
+		if n.UUID == ctx.Cluster.Myself.UUID {
+			continue
+		}
+		err := n.Purge(t, apiKey(r))
+		if err != nil {
+			ctx.SL.Warning(fmt.Sprintf("could not purge %s from %s: %s", t.Hash, n.Nickname, err.Error()))
+			resp.Failed = append(resp.Failed, n.Nickname)
+		} else {
+			resp.Nodes = append(resp.Nodes, n.Nickname)
+		}
+	}
+	jsonResponse(w, resp, 200)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func apiTestContext(t *testing.T) (Context, func()) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := makeNewClusterData(make([]NodeData, 0))
+	cfg := ConfigData{UploadDirectory: DirectoryList{dir + "/"}, UploadKeys: []string{"sekrit"}}.MyConfig()
+	c.TombstoneKeys = cfg.UploadKeys
+	st := NewSimilarityIndex(NewMemoryStore())
+	ctx := Context{Cluster: c, Cfg: cfg, SL: DummyLogger{}, Store: st, Similar: st}
+	return ctx, func() { os.RemoveAll(dir) }
+}
+
+func apiErrorMessage(t *testing.T, w *httptest.ResponseRecorder) string {
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Error("errors should be JSON")
+	}
+	var e apiError
+	json.Unmarshal(w.Body.Bytes(), &e)
+	return e.Error
+}
+
+func Test_ImagesAPIHandlerErrors(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	r := httptest.NewRequest("GET", "/api/images?key=sekrit", nil)
+	w := httptest.NewRecorder()
+	ImagesAPIHandler(w, r, ctx)
+	if w.Code != 405 || apiErrorMessage(t, w) == "" {
+		t.Error("GET should not be allowed")
+	}
+
+	r = httptest.NewRequest("POST", "/api/images?key=sekrit", strings.NewReader("x"))
+	r.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	ImagesAPIHandler(w, r, ctx)
+	if w.Code != 415 || apiErrorMessage(t, w) == "" {
+		t.Error("POST of a non-image content type should be a 415")
+	}
+
+	r = httptest.NewRequest("PUT", "/api/images?key=wrong", strings.NewReader("x"))
+	w = httptest.NewRecorder()
+	ImagesAPIHandler(w, r, ctx)
+	if w.Code != 403 || apiErrorMessage(t, w) == "" {
+		t.Error("bad key should be a 403")
+	}
+
+	r = httptest.NewRequest("PUT", "/api/images", strings.NewReader("not an image"))
+	r.Header.Set("X-Upload-Key", "sekrit")
+	w = httptest.NewRecorder()
+	ImagesAPIHandler(w, r, ctx)
+	if w.Code != 415 || apiErrorMessage(t, w) == "" {
+		t.Error("garbage body should be a 415")
+	}
+}
+
+func Test_ImagesAPIHandlerUpload(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	r := httptest.NewRequest("POST", "/api/images?key=sekrit",
+		bytes.NewReader(encodedTestImage("png", 8, 8)))
+	// lies about the type; the content is what counts
+	r.Header.Set("Content-Type", "image/jpeg")
+	w := httptest.NewRecorder()
+	ImagesAPIHandler(w, r, ctx)
+	if w.Code != 201 {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var id ImageData
+	err := json.Unmarshal(w.Body.Bytes(), &id)
+	if err != nil {
+		t.Fatal("response wasn't ImageData JSON")
+	}
+	if id.Extension != "png" {
+		t.Error("should have been detected as png")
+	}
+	if w.Header().Get("Location") != "/image/"+id.Hash+"/full/image.png" {
+		t.Errorf("wrong Location: %s", w.Header().Get("Location"))
+	}
+}
+
+func Test_ImageAPIHandlerDelete(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	img, err := ingestImage(ctx.Store,
+		bytes.NewReader(encodedTestImage("png", 8, 8)), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/api/images/" + img.Hash.String()
+
+	r := httptest.NewRequest("DELETE", url+"?key=wrong", nil)
+	w := httptest.NewRecorder()
+	ImageAPIHandler(w, r, ctx)
+	if w.Code != 403 {
+		t.Error("bad key should not be able to delete")
+	}
+
+	r = httptest.NewRequest("DELETE", url+"?key=sekrit", nil)
+	w = httptest.NewRecorder()
+	ImageAPIHandler(w, r, ctx)
+	if w.Code != 200 {
+		t.Fatalf("delete failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := ctx.Store.Stat(img.original()); !os.IsNotExist(err) {
+		t.Error("local copy should be gone")
+	}
+	if !ctx.Cluster.Tombstoned(img.Hash.String()) {
+		t.Error("should have left a tombstone")
+	}
+
+	// and it can't just be uploaded again
+	r = httptest.NewRequest("PUT", "/api/images?key=sekrit",
+		bytes.NewReader(encodedTestImage("png", 8, 8)))
+	w = httptest.NewRecorder()
+	ImagesAPIHandler(w, r, ctx)
+	if w.Code != 410 {
+		t.Errorf("re-upload of deleted image should be a 410, got %d", w.Code)
+	}
+	if _, err := ctx.Store.Stat(img.original()); !os.IsNotExist(err) {
+		t.Error("rejected re-upload left a copy behind")
+	}
+
+	ctx.Cfg.UploadKeys = nil
+	r = httptest.NewRequest("DELETE", url, nil)
+	w = httptest.NewRecorder()
+	ImageAPIHandler(w, r, ctx)
+	if w.Code != 403 {
+		t.Error("deletion should never be open without keys")
+	}
+}
+
+func Test_ImagesAPIHandlerTooLarge(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	ctx.Cfg.MaxImagePixels = 10
+	r := httptest.NewRequest("PUT", "/api/images?key=sekrit",
+		bytes.NewReader(encodedTestImage("png", 8, 8)))
+	w := httptest.NewRecorder()
+	ImagesAPIHandler(w, r, ctx)
+	if w.Code != 413 || apiErrorMessage(t, w) == "" {
+		t.Errorf("too many pixels should be a JSON 413, got %d", w.Code)
+	}
+
+	ctx.Cfg.MaxUploadBytes = 1
+	r = httptest.NewRequest("PUT", "/api/images?key=sekrit",
+		bytes.NewReader(make([]byte, 2<<20)))
+	w = httptest.NewRecorder()
+	ImagesAPIHandler(w, r, ctx)
+	if w.Code != 413 || apiErrorMessage(t, w) == "" {
+		t.Errorf("oversized body should be a JSON 413, got %d", w.Code)
+	}
+}
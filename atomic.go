@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writes the contents of r out to path without ever leaving a
+// partially written file there. Everything is streamed into a temp
+// file in the same directory (so the final rename is atomic),
+// synced to disk, and only then renamed into place.
+//
+// if expected is non-nil, the digest of what was actually written
+// (using expected's algorithm) must match it or the temp file is
+// thrown away and nothing at path is touched.
+func writeFileAtomic(path string, r io.Reader, expected *Hash) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	var w io.Writer = tmp
+	var h hash.Hash
+	if expected != nil {
+		h = expected.NewDigest()
+		w = io.MultiWriter(tmp, h)
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil && expected != nil {
+		digest := fmt.Sprintf("%x", h.Sum(nil))
+		if digest != expected.String() {
+			err = errors.New(fmt.Sprintf("digest mismatch writing %s: got %s", path, digest))
+		}
+	}
+	if err == nil {
+		err = renameIntoPlace(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// takes a fully written (and synced) temp file, gives it sane
+// permissions, and moves it to its real name. The rename is only
+// on disk once the directory it happened in is synced too.
+func renameIntoPlace(tmpname, path string) error {
+	// TempFile creates everything 0600
+	err := os.Chmod(tmpname, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpname, path)
+	if err != nil {
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	cerr := d.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_writeFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "some", "dir", "full.jpg")
+	err = writeFileAtomic(path, strings.NewReader("hello"), nil)
+	if err != nil {
+		t.Error("should have been able to write")
+	}
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "hello" {
+		t.Error("wrong contents")
+	}
+
+	// shorter contents must not leave any of the old ones behind
+	err = writeFileAtomic(path, strings.NewReader("hi"), nil)
+	if err != nil {
+		t.Error("should have been able to overwrite")
+	}
+	b, _ = ioutil.ReadFile(path)
+	if string(b) != "hi" {
+		t.Errorf("wrong contents after overwrite: %s", b)
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Error("temp file left behind")
+	}
+}
+
+func Test_writeFileAtomicDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sha1("hello")
+	good, _ := HashFromString("aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", "")
+	path := filepath.Join(dir, "full.jpg")
+	err = writeFileAtomic(path, strings.NewReader("hello"), good)
+	if err != nil {
+		t.Error("digest should have matched")
+	}
+
+	bad, _ := HashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	err = writeFileAtomic(path, strings.NewReader("goodbye"), bad)
+	if err == nil {
+		t.Error("digest mismatch should be an error")
+	}
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "hello" {
+		t.Error("mismatched write should not have replaced the file")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Error("temp file left behind after mismatch")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+)
+
+// how one entry in a batch upload went. Exactly one
+// of Image or Error will be set.
+type BatchResult struct {
+	Name  string     `json:"name"`
+	Image *ImageData `json:"image,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+func batchFailure(name string, err error) BatchResult {
+	return BatchResult{Name: name, Error: err.Error()}
+}
+
+// ingests and replicates a single image from a batch. Never fails
+// the batch; any problem is reported in the result.
+func (ctx Context) batchImage(name string, i io.ReadSeeker, size_hints, near_duplicates, key string) BatchResult {
+	id, err := ctx.upload(i, uploadMetadata(name, key), size_hints, near_duplicates, key)
+	if err != nil {
+		return batchFailure(name, err)
+	}
+	return BatchResult{Name: name, Image: &id}
+}
+
+func (ctx Context) batchUpload(fh *multipart.FileHeader, size_hints, near_duplicates, key string) BatchResult {
+	f, err := fh.Open()
+	if err != nil {
+		return batchFailure(fh.Filename, err)
+	}
+	defer f.Close()
+	return ctx.batchImage(fh.Filename, f, size_hints, near_duplicates, key)
+}
+
+// every file in the archive becomes its own entry in the results.
+// Archives are small compared to what's in them, so what comes
+// out is limited as it's unpacked: each entry to the size of an
+// upload, and the whole lot by MaxBatchBytes and MaxBatchEntries.
+func (ctx Context) batchArchive(fh *multipart.FileHeader, size_hints, near_duplicates, key string) []BatchResult {
+	var results []BatchResult
+	f, err := fh.Open()
+	if err != nil {
+		return []BatchResult{batchFailure(fh.Filename, err)}
+	}
+	defer f.Close()
+	entries, unpacked := 0, int64(0)
+	err = eachArchiveEntry(f, fh.Size, func(name string, r io.Reader) error {
+		entries++
+		if entries > ctx.Cfg.MaxBatchEntries {
+			return uploadError{413, fmt.Sprintf("archive has more than %d files", ctx.Cfg.MaxBatchEntries)}
+		}
+		// archive entries can't be seeked, and ingest needs two passes
+		tmp, n, err := spoolToTemp(r, ctx.Cfg.MaxUploadBytes)
+		unpacked += n
+		if err != nil {
+			results = append(results, batchFailure(name, err))
+		} else {
+			defer os.Remove(tmp.Name())
+			defer tmp.Close()
+			results = append(results, ctx.batchImage(name, tmp, size_hints, near_duplicates, key))
+		}
+		if unpacked > ctx.Cfg.MaxBatchBytes {
+			return uploadError{413, fmt.Sprintf("archive unpacks to more than %d bytes", ctx.Cfg.MaxBatchBytes)}
+		}
+		return nil
+	})
+	if err != nil {
+		// whatever we got out before it broke still counts
+		results = append(results, batchFailure(fh.Filename, err))
+	}
+	return results
+}
+
+// copies r to a temp file, as long as it's no more than limit
+// bytes (zero for no limit). Also says how much was read, which
+// is at most one byte past the limit.
+func spoolToTemp(r io.Reader, limit int64) (*os.File, int64, error) {
+	f, err := ioutil.TempFile("", "reticulum-batch-")
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit > 0 {
+		// one byte over is enough to know it's too big
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = ImageLimits{MaxBytes: limit}.checkLength(n)
+	}
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, n, err
+	}
+	return f, n, nil
+}
+
+type archiveFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// calls fn with each regular file in a zip, tar or tar.gz archive.
+// the format is worked out from the contents, not the filename.
+// An error from fn stops it there, and is returned.
+func eachArchiveEntry(f archiveFile, size int64, fn func(name string, r io.Reader) error) error {
+	magic := make([]byte, 4)
+	n, _ := f.ReadAt(magic, 0)
+	magic = magic[:n]
+
+	if bytes.HasPrefix(magic, []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				rc = ioutil.NopCloser(errReader{err})
+			}
+			err = fn(zf.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = f
+	if bytes.HasPrefix(magic, []byte("\x1f\x8b")) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// lets a broken archive entry flow through the normal
+// per-entry path and get reported there
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read(p []byte) (int, error) { return 0, e.err }
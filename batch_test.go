@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var archiveTestFiles = map[string][]byte{
+	"one.png":   encodedTestImage("png", 5, 5),
+	"two.jpg":   encodedTestImage("jpg", 5, 5),
+	"three.txt": []byte("not an image"),
+}
+
+func makeTestZip() []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.Create("somedir/")
+	for name, contents := range archiveTestFiles {
+		f, _ := zw.Create(name)
+		f.Write(contents)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func makeTestTar() []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "somedir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, contents := range archiveTestFiles {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))})
+		tw.Write(contents)
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(b)
+	gz.Close()
+	return buf.Bytes()
+}
+
+func Test_eachArchiveEntry(t *testing.T) {
+	archives := map[string][]byte{
+		"zip":    makeTestZip(),
+		"tar":    makeTestTar(),
+		"tar.gz": gzipped(makeTestTar()),
+	}
+	for kind, archive := range archives {
+		seen := map[string]bool{}
+		err := eachArchiveEntry(bytes.NewReader(archive), int64(len(archive)),
+			func(name string, r io.Reader) error {
+				b, _ := ioutil.ReadAll(r)
+				if !bytes.Equal(b, archiveTestFiles[name]) {
+					t.Errorf("%s: wrong contents for %s", kind, name)
+				}
+				seen[name] = true
+				return nil
+			})
+		if err != nil {
+			t.Errorf("%s: %s", kind, err)
+		}
+		if len(seen) != len(archiveTestFiles) {
+			t.Errorf("%s: expected %d entries, got %d", kind, len(archiveTestFiles), len(seen))
+		}
+	}
+
+	garbage := []byte("this is not an archive of any kind")
+	err := eachArchiveEntry(bytes.NewReader(garbage), int64(len(garbage)),
+		func(name string, r io.Reader) error { return nil })
+	if err == nil {
+		t.Error("garbage should not be readable as an archive")
+	}
+
+	stop := errors.New("stop")
+	for kind, archive := range archives {
+		calls := 0
+		err := eachArchiveEntry(bytes.NewReader(archive), int64(len(archive)),
+			func(name string, r io.Reader) error {
+				calls++
+				return stop
+			})
+		if err != stop || calls != 1 {
+			t.Errorf("%s: an error should stop it at the first entry", kind)
+		}
+	}
+}
+
+func Test_spoolToTemp(t *testing.T) {
+	f, n, err := spoolToTemp(bytes.NewReader(make([]byte, 10)), 10)
+	if err != nil || n != 10 {
+		t.Fatalf("should fit: %d %v", n, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	_, n, err = spoolToTemp(bytes.NewReader(make([]byte, 1000)), 10)
+	if ue, ok := err.(uploadError); !ok || ue.Status != 413 {
+		t.Errorf("over the limit should be a 413: %v", err)
+	}
+	if n != 11 {
+		t.Errorf("shouldn't have read more than a byte past the limit: %d", n)
+	}
+}
+
+func batchRequest(t *testing.T, archive []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("archive", "images.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(archive)
+	mw.WriteField("key", "sekrit")
+	mw.Close()
+	r := httptest.NewRequest("POST", "/batch/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func batchErrors(t *testing.T, w *httptest.ResponseRecorder) []string {
+	var results []BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("bad response: %d %s", w.Code, w.Body.String())
+	}
+	var errs []string
+	for _, r := range results {
+		if r.Error != "" {
+			errs = append(errs, r.Error)
+		}
+	}
+	return errs
+}
+
+func Test_BatchHandlerLimits(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	ctx.Cfg.MaxBatchEntries = 2
+	w := httptest.NewRecorder()
+	BatchHandler(w, batchRequest(t, makeTestZip()), ctx)
+	errs := batchErrors(t, w)
+	if len(errs) == 0 || !strings.Contains(errs[len(errs)-1], "more than 2 files") {
+		t.Errorf("should have stopped after two files: %v", errs)
+	}
+
+	// every entry is bigger than this
+	ctx.Cfg.MaxBatchEntries = 1000
+	ctx.Cfg.MaxBatchBytes = 10
+	w = httptest.NewRecorder()
+	BatchHandler(w, batchRequest(t, makeTestZip()), ctx)
+	errs = batchErrors(t, w)
+	if len(errs) == 0 || !strings.Contains(errs[len(errs)-1], "unpacks to more than 10 bytes") {
+		t.Errorf("should have stopped after the first file: %v", errs)
+	}
+	r := batchRequest(t, makeTestZip())
+	r.ContentLength = 2 << 20
+	w = httptest.NewRecorder()
+	BatchHandler(w, r, ctx)
+	if w.Code != 413 {
+		t.Errorf("body is over the batch limit, should be a 413: %d", w.Code)
+	}
+	if msg := apiErrorMessage(t, w); !strings.Contains(msg, "limit") {
+		t.Errorf("should say what the limit is: %q", msg)
+	}
+
+	ctx.Cfg.MaxBatchBytes = 1 << 20
+	ctx.Cfg.MaxUploadBytes = 20
+	w = httptest.NewRecorder()
+	BatchHandler(w, batchRequest(t, makeTestZip()), ctx)
+	errs = batchErrors(t, w)
+	if len(errs) != len(archiveTestFiles) {
+		t.Errorf("every entry is over the upload limit: %v", errs)
+	}
+}
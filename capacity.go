@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// free and total bytes on the filesystem that dir lives on.
+// free is what's available to us, not counting any space
+// reserved for root.
+func diskUsage(dir string) (uint64, uint64, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(dir, &fs)
+	if err != nil {
+		return 0, 0, err
+	}
+	bsize := uint64(fs.Bsize)
+	return fs.Bavail * bsize, fs.Blocks * bsize, nil
+}
+
+// adds up diskUsage across several directories, counting
+// each filesystem once even if more than one of them is on it.
+// Directories we can't check are left out.
+func totalDiskUsage(dirs []string) (uint64, uint64, error) {
+	var free, total uint64
+	var err error
+	seen := make(map[uint64]bool)
+	counted := 0
+	for _, dir := range dirs {
+		var st syscall.Stat_t
+		if err = syscall.Stat(dir, &st); err != nil {
+			continue
+		}
+		dev := uint64(st.Dev)
+		if seen[dev] {
+			continue
+		}
+		f, t, e := diskUsage(dir)
+		if e != nil {
+			err = e
+			continue
+		}
+		seen[dev] = true
+		free += f
+		total += t
+		counted++
+	}
+	if counted == 0 {
+		if err == nil {
+			err = errNoDirectories
+		}
+		return 0, 0, err
+	}
+	return free, total, nil
+}
+
+// fraction of the disk that's in use. Nodes that haven't
+// told us their capacity (older versions, or ones we've only
+// heard about second hand) come out as empty.
+func (n NodeData) UsedFraction() float64 {
+	if n.TotalBytes == 0 || n.FreeBytes > n.TotalBytes {
+		return 0
+	}
+	return float64(n.TotalBytes-n.FreeBytes) / float64(n.TotalBytes)
+}
+
+// a high water mark of zero turns the check off
+func (n NodeData) NearlyFull(high_water_mark float64) bool {
+	return high_water_mark > 0 && n.UsedFraction() >= high_water_mark
+}
+
+// for the status page
+func (n NodeData) CapacityString() string {
+	if n.TotalBytes == 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s free of %s (%.0f%% used)",
+		humanBytes(n.FreeBytes), humanBytes(n.TotalBytes), n.UsedFraction()*100)
+}
+
+func humanBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func (c *Cluster) SetCapacity(free, total uint64) {
+	r := make(chan bool)
+	c.chF <- func() {
+		c.Myself.FreeBytes = free
+		c.Myself.TotalBytes = total
+		r <- true
+	}
+	<-r
+}
+
+// dirs gives the directories that currently count towards
+// our capacity, since they can come and go
+func (c *Cluster) CheckCapacity(dirs func() []string, sl Logger) {
+	free, total, err := totalDiskUsage(dirs())
+	if err != nil {
+		sl.Err(fmt.Sprintf("couldn't check free space: %s", err))
+		// nothing healthy to write to is as good as full
+		free, total = 0, 1
+	}
+	c.SetCapacity(free, total)
+}
+
+// keeps our own advertised capacity up to date
+// run this as a goroutine
+func (c *Cluster) MonitorCapacity(dirs func() []string, sleep int, sl Logger) {
+	sl.Info("starting capacity monitor")
+	for {
+		time.Sleep(time.Duration(sleep) * time.Second)
+		c.CheckCapacity(dirs, sl)
+	}
+}
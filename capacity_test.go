@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_diskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	free, total, err := diskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total == 0 || free > total {
+		t.Errorf("nonsense capacity: %d free of %d", free, total)
+	}
+	if _, _, err := diskUsage(dir + "/nonexistent"); err == nil {
+		t.Error("should fail on a missing directory")
+	}
+}
+
+func Test_totalDiskUsage(t *testing.T) {
+	dirs, cleanup := multiTestDirs(t, 2)
+	defer cleanup()
+	free, total, _ := diskUsage(dirs[0])
+	f, tot, err := totalDiskUsage(dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// free space can move a little between calls
+	if tot != total || f > free*2 {
+		t.Error("directories on the same filesystem should only count once")
+	}
+	if _, _, err := totalDiskUsage(nil); err == nil {
+		t.Error("no directories should be an error")
+	}
+
+	_, c := makeNewClusterData(nil)
+	c.CheckCapacity(func() []string { return nil }, DummyLogger{})
+	if !c.Myself.NearlyFull(0.95) {
+		t.Error("no healthy directories should count as full")
+	}
+}
+
+func Test_NearlyFull(t *testing.T) {
+	n := NodeData{}
+	if n.NearlyFull(0.5) {
+		t.Error("unknown capacity shouldn't count as full")
+	}
+	if n.CapacityString() != "unknown" {
+		t.Error("wrong capacity string for unknown")
+	}
+	n.FreeBytes, n.TotalBytes = 10, 100
+	if !n.NearlyFull(0.9) {
+		t.Error("90% used should be at the high water mark")
+	}
+	if n.NearlyFull(0.95) {
+		t.Error("not there yet")
+	}
+	if n.NearlyFull(0) {
+		t.Error("zero should turn the check off")
+	}
+	if n.CapacityString() != "10 B free of 100 B (90% used)" {
+		t.Errorf("wrong capacity string: %s", n.CapacityString())
+	}
+	if humanBytes(3<<30) != "3.0 GiB" {
+		t.Errorf("wrong human size: %s", humanBytes(3<<30))
+	}
+}
+
+func Test_WriteableNeighborsSkipsFull(t *testing.T) {
+	_, c := makeNewClusterData(nil)
+	c.HighWaterMark = 0.9
+	c.AddNeighbor(NodeData{Nickname: "roomy", UUID: "roomy", Writeable: true, FreeBytes: 90, TotalBytes: 100})
+	c.AddNeighbor(NodeData{Nickname: "full", UUID: "full", Writeable: true, FreeBytes: 1, TotalBytes: 100})
+	for _, n := range c.WriteableNeighbors() {
+		if n.UUID == "full" {
+			t.Error("full node should not be written to")
+		}
+	}
+	if len(c.WriteableNeighbors()) != 2 {
+		t.Error("should still have ourself and the roomy one")
+	}
+	for _, n := range c.WriteOrder("fb682e05b9be61797601e60165825c0b089f755e") {
+		if n.UUID == "full" {
+			t.Error("full node should not be in the write order")
+		}
+	}
+	found := false
+	for _, n := range c.ReadOrder("fb682e05b9be61797601e60165825c0b089f755e") {
+		if n.UUID == "full" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("full nodes can still be read from")
+	}
+}
+
+func Test_AnnounceCapacity(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	ctx.Cluster.SetCapacity(500, 1000)
+
+	n := NodeData{Nickname: "other", UUID: "other-uuid", BaseUrl: "localhost:8081",
+		Writeable: true, FreeBytes: 20, TotalBytes: 100}
+	params := makeParams(n)
+	if params.Get("free_bytes") != "20" || params.Get("total_bytes") != "100" {
+		t.Error("capacity missing from announce params")
+	}
+	announce := func(params url.Values) string {
+		r := httptest.NewRequest("POST", "/announce/", strings.NewReader(params.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		AnnounceHandler(w, r, ctx)
+		return w.Body.String()
+	}
+	body := announce(params)
+	if !strings.Contains(body, `"free_bytes":500`) {
+		t.Errorf("should tell them how full we are: %s", body)
+	}
+	nd, ok := ctx.Cluster.FindNeighborByUUID("other-uuid")
+	if !ok || nd.FreeBytes != 20 || nd.TotalBytes != 100 {
+		t.Error("didn't record a new neighbor's capacity")
+	}
+
+	n.FreeBytes = 5
+	announce(makeParams(n))
+	nd, _ = ctx.Cluster.FindNeighborByUUID("other-uuid")
+	if nd.FreeBytes != 5 {
+		t.Error("didn't update an existing neighbor's capacity")
+	}
+}
+
+func Test_StashHandlerNearlyFull(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	ctx.Cluster.SetCapacity(1, 100)
+
+	r := httptest.NewRequest("POST", "/stash/", nil)
+	w := httptest.NewRecorder()
+	StashHandler(w, r, ctx)
+	if w.Code != 507 {
+		t.Errorf("full node should refuse stashes, got %d", w.Code)
+	}
+}
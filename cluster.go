@@ -29,19 +29,27 @@ type Cache interface {
 // there should probably be a map for that so we don't
 // have to run through the whole list every time
 type Cluster struct {
-	Myself     NodeData
-	neighbors  map[string]NodeData
-	gcpeers    PeerList
-	Imagecache CacheGetter
-	chF        chan func()
+	Myself           NodeData
+	neighbors        map[string]NodeData
+	gcpeers          PeerList
+	Imagecache       CacheGetter
+	chF              chan func()
+	tombstones       map[string]Tombstone
+	tombstoneJournal string
+	// the upload keys, which tombstones are signed with
+	TombstoneKeys []string
+	// nodes using more than this fraction of their disk
+	// are left out of the write ring
+	HighWaterMark float64
 }
 
 func NewCluster(myself NodeData, cache Cache, cache_size int64) *Cluster {
 	c := &Cluster{
-		Myself:    myself,
-		neighbors: make(map[string]NodeData),
-		chF:       make(chan func()),
-		gcpeers:   cache.MakeInitialPool(myself.GroupcacheUrl),
+		Myself:     myself,
+		neighbors:  make(map[string]NodeData),
+		chF:        make(chan func()),
+		gcpeers:    cache.MakeInitialPool(myself.GroupcacheUrl),
+		tombstones: make(map[string]Tombstone),
 	}
 	c.Imagecache = cache.MakeCache(c, cache_size)
 	go c.backend()
@@ -68,6 +76,18 @@ func (c *Cluster) AddNeighbor(nd NodeData) {
 	}
 }
 
+// a copy of our own entry. SetCapacity changes it as we go,
+// so, like the neighbors, it's only read on the backend goroutine
+func (c *Cluster) GetMyself() NodeData {
+	r := make(chan NodeData)
+	go func() {
+		c.chF <- func() {
+			r <- c.Myself
+		}
+	}()
+	return <-r
+}
+
 type gnresp struct {
 	N []NodeData
 }
@@ -105,7 +125,7 @@ type fResp struct {
 	Err bool
 }
 
-func (c Cluster) FindNeighborByUUID(uuid string) (*NodeData, bool) {
+func (c *Cluster) FindNeighborByUUID(uuid string) (*NodeData, bool) {
 	r := make(chan fResp)
 	go func() {
 		c.chF <- func() {
@@ -125,6 +145,13 @@ func (c *Cluster) UpdateNeighbor(neighbor NodeData) {
 			n.BaseUrl = neighbor.BaseUrl
 			n.GroupcacheUrl = neighbor.GroupcacheUrl
 			n.Writeable = neighbor.Writeable
+			// second hand reports of how full a node is
+			// shouldn't clobber fresher ones
+			if !neighbor.LastSeen.Before(n.LastSeen) {
+				n.FreeBytes = neighbor.FreeBytes
+				n.TotalBytes = neighbor.TotalBytes
+				n.OutputFormats = neighbor.OutputFormats
+			}
 			if neighbor.LastSeen.Sub(n.LastSeen) > 0 {
 				n.LastSeen = neighbor.LastSeen
 			}
@@ -147,7 +174,7 @@ type listResp struct {
 	Ns []NodeData
 }
 
-func (c Cluster) NeighborsInclusive() []NodeData {
+func (c *Cluster) NeighborsInclusive() []NodeData {
 	r := make(chan listResp)
 	go func() {
 		c.chF <- func() {
@@ -169,11 +196,11 @@ func (c Cluster) NeighborsInclusive() []NodeData {
 	return resp.Ns
 }
 
-func (c Cluster) WriteableNeighbors() []NodeData {
+func (c *Cluster) WriteableNeighbors() []NodeData {
 	var all = c.NeighborsInclusive()
 	var p []NodeData // == nil
 	for _, i := range all {
-		if i.Writeable {
+		if i.Writeable && !i.NearlyFull(c.HighWaterMark) {
 			p = append(p, i)
 		}
 	}
@@ -191,19 +218,19 @@ func (p RingEntryList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (p RingEntryList) Len() int           { return len(p) }
 func (p RingEntryList) Less(i, j int) bool { return p[i].Hash < p[j].Hash }
 
-func (c Cluster) Ring() RingEntryList {
+func (c *Cluster) Ring() RingEntryList {
 	// TODO: cache the ring so we don't have to regenerate
 	// every time. it only changes when a node joins or leaves
 	return neighborsToRing(c.NeighborsInclusive())
 }
 
-func (c Cluster) WriteRing() RingEntryList {
+func (c *Cluster) WriteRing() RingEntryList {
 	return neighborsToRing(c.WriteableNeighbors())
 }
 
-func (cluster *Cluster) Stash(ahash *Hash, filename string, size_hints string, replication int, min_replication int) []string {
+func (cluster *Cluster) Stash(ri *ImageSpecifier, st Store, size_hints string, replication int, min_replication int) []string {
 	// we don't have the full-size, so check the cluster
-	nodes_to_check := cluster.WriteOrder(ahash.String())
+	nodes_to_check := cluster.WriteOrder(ri.Hash.String())
 	saved_to := make([]string, replication)
 	var save_count = 0
 	// TODO: parallelize this
@@ -214,7 +241,7 @@ func (cluster *Cluster) Stash(ahash *Hash, filename string, size_hints string, r
 			// only have the first node on the list eagerly resize images
 			size_hints = ""
 		}
-		if n.Stash(filename, size_hints) {
+		if n.Stash(ri, size_hints, st) {
 			saved_to[save_count] = n.Nickname
 			save_count++
 			n.LastSeen = time.Now()
@@ -249,13 +276,13 @@ func neighborsToRing(neighbors []NodeData) RingEntryList {
 
 // returns the list of all nodes in the order
 // that the given hash will choose to write to them
-func (c Cluster) WriteOrder(hash string) []NodeData {
+func (c *Cluster) WriteOrder(hash string) []NodeData {
 	return hashOrder(hash, len(c.GetNeighbors())+1, c.WriteRing())
 }
 
 // returns the list of all nodes in the order
 // that the given hash will choose to try to read from them
-func (c Cluster) ReadOrder(hash string) []NodeData {
+func (c *Cluster) ReadOrder(hash string) []NodeData {
 	return hashOrder(hash, len(c.GetNeighbors())+1, c.Ring())
 }
 
@@ -312,7 +339,7 @@ func (c *Cluster) Gossip(i, base_time int, sl Logger) {
 			jitter = rand.Intn(30)
 			time.Sleep(time.Duration(base_time+jitter) * time.Second)
 			sl.Info(fmt.Sprintf("node %s pinging %s", c.Myself.Nickname, n.Nickname))
-			resp, err := n.Ping(c.Myself)
+			resp, err := n.Ping(c.GetMyself())
 			if err != nil {
 				sl.Info(fmt.Sprintf("error on node %s pinging %s", c.Myself.Nickname, n.Nickname))
 				c.FailedNeighbor(n)
@@ -323,11 +350,21 @@ func (c *Cluster) Gossip(i, base_time int, sl Logger) {
 			n.Nickname = resp.Nickname
 			n.Location = resp.Location
 			n.GroupcacheUrl = resp.GroupcacheUrl
+			n.FreeBytes = resp.FreeBytes
+			n.TotalBytes = resp.TotalBytes
+			n.OutputFormats = resp.OutputFormats
 			n.LastSeen = time.Now()
 			c.UpdateNeighbor(n)
 			for _, neighbor := range resp.Neighbors {
 				c.updateNeighbor(neighbor, sl)
 			}
+			// the verifier takes care of actually removing
+			// any local copies when it gets to them
+			for _, t := range resp.Tombstones {
+				if c.AddTombstone(t) {
+					sl.Info(fmt.Sprintf("heard about deletion of %s via gossip", t.Hash))
+				}
+			}
 		}
 	}
 }
@@ -359,6 +396,9 @@ func (c *Cluster) RetrieveImage(ri *ImageSpecifier) ([]byte, error) {
 			// checking ourself would be silly
 			continue
 		}
+		if !n.CanMake(ri.Extension) {
+			continue
+		}
 		img, err := n.RetrieveImage(ri)
 		if err == nil {
 			// got it, return it
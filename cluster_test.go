@@ -19,20 +19,29 @@ func makeNewClusterData(neighbors []NodeData) (NodeData, *Cluster) {
 	}
 
 	if cluster == nil {
-
 		gcp := &GroupCacheProxy{}
-		c := NewCluster(myself, gcp, 64)
-		for _, n := range neighbors {
-			c.AddNeighbor(n)
-		}
-		cluster = c
-		return myself, cluster
+		cluster = NewCluster(myself, gcp, 64)
 	} else {
-		cluster.Myself = myself
-		cluster.neighbors = map[string]NodeData{}
-		cluster.gcpeers.Set()
-		return myself, cluster
+		// goroutines left over from earlier tests may still
+		// be using it, so it's reset on the backend like
+		// anything else that changes it
+		done := make(chan bool)
+		cluster.chF <- func() {
+			cluster.Myself = myself
+			cluster.neighbors = map[string]NodeData{}
+			cluster.tombstones = map[string]Tombstone{}
+			cluster.tombstoneJournal = ""
+			cluster.TombstoneKeys = nil
+			cluster.HighWaterMark = 0
+			cluster.gcpeers.Set()
+			done <- true
+		}
+		<-done
 	}
+	for _, n := range neighbors {
+		cluster.AddNeighbor(n)
+	}
+	return myself, cluster
 }
 
 func Test_ClusterOfOneInitialNeighbors(t *testing.T) {
@@ -234,3 +243,25 @@ func Test_FailedNeighbor(t *testing.T) {
 		t.Error("failed notification didn't take")
 	}
 }
+
+func Test_GetMyself(t *testing.T) {
+	_, c := makeNewClusterData(make([]NodeData, 0))
+	done := make(chan bool)
+	go func() {
+		for i := uint64(1); i <= 100; i++ {
+			c.SetCapacity(i, 100)
+		}
+		done <- true
+	}()
+	// (go test -race would catch these reads if they
+	// weren't on the backend goroutine)
+	for i := 0; i < 100; i++ {
+		if m := c.GetMyself(); m.TotalBytes != 0 && m.TotalBytes != 100 {
+			t.Fatal("half updated")
+		}
+	}
+	<-done
+	if m := c.GetMyself(); m.FreeBytes != 100 || m.UUID != "test-uuid" {
+		t.Errorf("wrong node data: %v", m)
+	}
+}
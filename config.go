@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/json"
+	"net"
+	"strings"
+)
+
 // the structure of the config.json file
 // where config info is stored
 type ConfigData struct {
@@ -11,7 +17,7 @@ type ConfigData struct {
 	Writeable              bool
 	NumResizeWorkers       int
 	UploadKeys             []string
-	UploadDirectory        string
+	UploadDirectory        DirectoryList
 	Neighbors              []NodeData
 	Replication            int
 	MinReplication         int
@@ -22,6 +28,96 @@ type ConfigData struct {
 	GoMaxProcs             int
 	GroupcacheUrl          string
 	GroupcacheSize         int64
+	// limits on what /fetch/ will download
+	FetchTimeout      int
+	FetchMaxBytes     int64
+	FetchMaxRedirects int
+	FetchContentTypes []string
+	// /fetch/ only goes to public addresses, unless they're in
+	// one of these CIDR ranges (like "10.1.0.0/16", for an image
+	// server on the same private network)
+	FetchAllowedNetworks []string
+	// how big an upload we'll accept, and how big an image
+	// we're willing to decode (to stop decompression bombs)
+	MaxUploadBytes int64
+	MaxImageWidth  int
+	MaxImageHeight int
+	MaxImagePixels int64
+	// how much a /batch/ upload can hold: MaxBatchBytes (default
+	// 1GiB) for the whole request, and for everything unpacked
+	// from any one archive in it, and MaxBatchEntries (default
+	// 1000) files in an archive
+	MaxBatchBytes   int64
+	MaxBatchEntries int
+	// "files" (the default) stores every image in its own file.
+	// "pack" appends derivatives, and originals as well if
+	// PackOriginals is set, to large pack files instead.
+	StorageMode          string
+	PackOriginals        bool
+	PackDirectory        string
+	PackMaxBytes         int64
+	PackCompactThreshold float64
+	PackCompactSleep     int
+	// stop taking stashes once this fraction of the upload
+	// directories' disks is used. Zero means 0.95, above 1
+	// turns the check off.
+	HighWaterMark float64
+	// how often to check on the upload directories, for
+	// both free space and whether they're still working
+	CapacityCheckSleep int
+	// how many bytes of resized images to keep around before
+	// the least recently used ones get thrown out. zero (the
+	// default) keeps them forever.
+	DerivativeBudget int64
+	// what new uploads are addressed by: "sha256" (the default)
+	// or "sha1". Either way, images already stored under the
+	// other one keep working.
+	HashAlgorithm string
+	// how far apart (in bits of their perceptual hashes) two
+	// images can be and still count as near duplicates
+	NearDuplicateDistance int
+	// what resizes images: "native" (the default) or "imagemagick".
+	// The other one is still tried if it can't manage.
+	ResizeEngine string
+	// keeping convert in check. It's killed after
+	// ImageMagickTimeout seconds (default 60), and told not to
+	// use more than ImageMagickMemoryLimit (an imagemagick size,
+	// like "256MiB", the default) or ImageMagickThreads threads
+	// (default 1).
+	ImageMagickTimeout     int
+	ImageMagickMemoryLimit string
+	ImageMagickThreads     int
+	// what transparent images are put on when they're converted
+	// to a format without transparency (jpg). "#rrggbb" or "#rgb";
+	// white if not set.
+	FlattenBackground string
+	// what image.auto can turn into, best first, if the client
+	// says it can take them. Otherwise it gets the original's
+	// format. Defaults to avif then webp; an empty list means
+	// it's always the original's format.
+	AutoFormats []string
+	// how many days a deletion keeps getting passed around the
+	// cluster (default 30). A node that joins, or comes back after
+	// being down for longer than that, is sent all of them once.
+	TombstoneGossipDays int
+}
+
+// UploadDirectory can be a single directory, or a list of them
+// (one per disk, say). Either way it comes out as a list.
+type DirectoryList []string
+
+func (d *DirectoryList) UnmarshalJSON(b []byte) error {
+	var dir string
+	if err := json.Unmarshal(b, &dir); err == nil {
+		*d = DirectoryList{dir}
+		return nil
+	}
+	var dirs []string
+	if err := json.Unmarshal(b, &dirs); err != nil {
+		return err
+	}
+	*d = DirectoryList(dirs)
+	return nil
 }
 
 func (c ConfigData) MyNode() NodeData {
@@ -38,7 +134,25 @@ func (c ConfigData) MyNode() NodeData {
 
 func (c ConfigData) MyConfig() SiteConfig {
 	// todo: defaults should go here
-	// todo: normalize uploaddirectory trailing slash
+	// everything downstream just tacks paths onto the end
+	// of these, so make sure they all end with a slash
+	upload_directories := make([]string, 0, len(c.UploadDirectory))
+	for _, dir := range c.UploadDirectory {
+		if dir == "" {
+			continue
+		}
+		if !strings.HasSuffix(dir, "/") {
+			dir = dir + "/"
+		}
+		upload_directories = append(upload_directories, dir)
+	}
+	// the first one also gets the things that there's only
+	// one of per node (tombstones, packs)
+	upload_directory := ""
+	if len(upload_directories) > 0 {
+		upload_directory = upload_directories[0]
+	}
+
 	numWorkers := c.NumResizeWorkers
 	if numWorkers < 1 {
 		// come on! we need at least one
@@ -72,6 +186,19 @@ func (c ConfigData) MyConfig() SiteConfig {
 		convert_path = "/usr/bin/convert"
 	}
 
+	imagemagick_timeout := c.ImageMagickTimeout
+	if imagemagick_timeout < 1 {
+		imagemagick_timeout = 60
+	}
+	imagemagick_memory_limit := c.ImageMagickMemoryLimit
+	if imagemagick_memory_limit == "" {
+		imagemagick_memory_limit = "256MiB"
+	}
+	imagemagick_threads := c.ImageMagickThreads
+	if imagemagick_threads < 1 {
+		imagemagick_threads = 1
+	}
+
 	go_max_procs := c.GoMaxProcs
 	if go_max_procs < 1 {
 		go_max_procs = 1
@@ -82,10 +209,115 @@ func (c ConfigData) MyConfig() SiteConfig {
 		groupcache_size = 64 << 20
 	}
 
+	fetch_timeout := c.FetchTimeout
+	if fetch_timeout < 1 {
+		fetch_timeout = 30
+	}
+	fetch_max_bytes := c.FetchMaxBytes
+	if fetch_max_bytes < 1 {
+		fetch_max_bytes = 32 << 20
+	}
+	// zero is meaningful here (don't follow any redirects)
+	fetch_max_redirects := c.FetchMaxRedirects
+	if fetch_max_redirects < 0 {
+		fetch_max_redirects = 0
+	}
+	fetch_content_types := c.FetchContentTypes
+	if len(fetch_content_types) == 0 {
+		fetch_content_types = []string{"image/jpeg", "image/png", "image/gif"}
+	}
+
+	// a dimension limit of zero means no limit, but bytes
+	// and total pixels always get one
+	max_upload_bytes := c.MaxUploadBytes
+	if max_upload_bytes < 1 {
+		max_upload_bytes = 64 << 20
+	}
+	max_image_pixels := c.MaxImagePixels
+	if max_image_pixels < 1 {
+		max_image_pixels = 100000000
+	}
+	max_batch_bytes := c.MaxBatchBytes
+	if max_batch_bytes < 1 {
+		max_batch_bytes = 1 << 30
+	}
+	max_batch_entries := c.MaxBatchEntries
+	if max_batch_entries < 1 {
+		max_batch_entries = 1000
+	}
+
+	storage_mode := c.StorageMode
+	if storage_mode == "" {
+		storage_mode = "files"
+	}
+	pack_directory := c.PackDirectory
+	if pack_directory == "" {
+		pack_directory = upload_directory + "packs/"
+	}
+	pack_max_bytes := c.PackMaxBytes
+	if pack_max_bytes < 1 {
+		pack_max_bytes = 1 << 30
+	}
+	// compact a pack once half of it is dead
+	pack_compact_threshold := c.PackCompactThreshold
+	if pack_compact_threshold <= 0 {
+		pack_compact_threshold = 0.5
+	}
+	pack_compact_sleep := c.PackCompactSleep
+	if pack_compact_sleep < 1 {
+		pack_compact_sleep = 3600
+	}
+
+	high_water_mark := c.HighWaterMark
+	if high_water_mark <= 0 {
+		high_water_mark = 0.95
+	}
+	capacity_check_sleep := c.CapacityCheckSleep
+	if capacity_check_sleep < 1 {
+		capacity_check_sleep = 30
+	}
+	hash_algorithm := c.HashAlgorithm
+	if hash_algorithm == "" {
+		hash_algorithm = defaultHashAlgorithm
+	}
+
+	// out of 64. a few bits either way is usually just
+	// re-encoding or resizing
+	near_duplicate_distance := c.NearDuplicateDistance
+	if near_duplicate_distance < 1 {
+		near_duplicate_distance = 10
+	}
+
+	flatten_background := c.FlattenBackground
+	if flatten_background == "" {
+		flatten_background = "#ffffff"
+	}
+
+	auto_formats := c.AutoFormats
+	if auto_formats == nil {
+		auto_formats = []string{"avif", "webp"}
+	}
+
+	tombstone_gossip_days := c.TombstoneGossipDays
+	if tombstone_gossip_days < 1 {
+		tombstone_gossip_days = 30
+	}
+
+	resize_engine := c.ResizeEngine
+	if resize_engine == "" {
+		resize_engine = resizeEngineNative
+	}
+
+	derivative_budget := c.DerivativeBudget
+	if derivative_budget < 0 {
+		derivative_budget = 0
+	}
+
 	return SiteConfig{
 		Port:                   c.Port,
 		UploadKeys:             c.UploadKeys,
-		UploadDirectory:        c.UploadDirectory,
+		UploadDirectory:        upload_directory,
+		UploadDirectories:      upload_directories,
 		NumResizeWorkers:       numWorkers,
 		Replication:            replication,
 		MinReplication:         min_replication,
@@ -93,10 +325,39 @@ func (c ConfigData) MyConfig() SiteConfig {
 		GossiperSleep:          gossiper_sleep,
 		VerifierSleep:          verifier_sleep,
 		ImageMagickConvertPath: convert_path,
+		ImageMagickTimeout:     imagemagick_timeout,
+		ImageMagickMemoryLimit: imagemagick_memory_limit,
+		ImageMagickThreads:     imagemagick_threads,
 		GoMaxProcs:             c.GoMaxProcs,
 		Writeable:              c.Writeable,
 		GroupcacheUrl:          c.GroupcacheUrl,
 		GroupcacheSize:         c.GroupcacheSize,
+		FetchTimeout:           fetch_timeout,
+		FetchMaxBytes:          fetch_max_bytes,
+		FetchMaxRedirects:      fetch_max_redirects,
+		FetchContentTypes:      fetch_content_types,
+		FetchAllowedNetworks:   c.FetchAllowedNetworks,
+		MaxUploadBytes:         max_upload_bytes,
+		MaxImageWidth:          c.MaxImageWidth,
+		MaxImageHeight:         c.MaxImageHeight,
+		MaxImagePixels:         max_image_pixels,
+		MaxBatchBytes:          max_batch_bytes,
+		MaxBatchEntries:        max_batch_entries,
+		StorageMode:            storage_mode,
+		PackOriginals:          c.PackOriginals,
+		PackDirectory:          pack_directory,
+		PackMaxBytes:           pack_max_bytes,
+		PackCompactThreshold:   pack_compact_threshold,
+		PackCompactSleep:       pack_compact_sleep,
+		HighWaterMark:          high_water_mark,
+		CapacityCheckSleep:     capacity_check_sleep,
+		DerivativeBudget:       derivative_budget,
+		HashAlgorithm:          hash_algorithm,
+		NearDuplicateDistance:  near_duplicate_distance,
+		ResizeEngine:           resize_engine,
+		FlattenBackground:      flatten_background,
+		AutoFormats:            auto_formats,
+		TombstoneGossipDays:    tombstone_gossip_days,
 	}
 }
 
@@ -106,6 +367,7 @@ type SiteConfig struct {
 	Port                   int64
 	UploadKeys             []string
 	UploadDirectory        string
+	UploadDirectories      []string
 	NumResizeWorkers       int
 	Replication            int
 	MinReplication         int
@@ -113,10 +375,57 @@ type SiteConfig struct {
 	GossiperSleep          int
 	VerifierSleep          int
 	ImageMagickConvertPath string
+	ImageMagickTimeout     int
+	ImageMagickMemoryLimit string
+	ImageMagickThreads     int
 	GoMaxProcs             int
 	Writeable              bool
 	GroupcacheUrl          string
 	GroupcacheSize         int64
+	FetchTimeout           int
+	FetchMaxBytes          int64
+	FetchMaxRedirects      int
+	FetchContentTypes      []string
+	FetchAllowedNetworks   []string
+	MaxUploadBytes         int64
+	MaxImageWidth          int
+	MaxImageHeight         int
+	MaxImagePixels         int64
+	MaxBatchBytes          int64
+	MaxBatchEntries        int
+	StorageMode            string
+	PackOriginals          bool
+	PackDirectory          string
+	PackMaxBytes           int64
+	PackCompactThreshold   float64
+	PackCompactSleep       int
+	HighWaterMark          float64
+	CapacityCheckSleep     int
+	DerivativeBudget       int64
+	HashAlgorithm          string
+	NearDuplicateDistance  int
+	ResizeEngine           string
+	FlattenBackground      string
+	AutoFormats            []string
+	TombstoneGossipDays    int
+}
+
+// how big an image we're willing to deal with.
+// zero for any of them means no limit.
+type ImageLimits struct {
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+}
+
+func (s SiteConfig) Limits() ImageLimits {
+	return ImageLimits{
+		MaxBytes:  s.MaxUploadBytes,
+		MaxWidth:  s.MaxImageWidth,
+		MaxHeight: s.MaxImageHeight,
+		MaxPixels: s.MaxImagePixels,
+	}
 }
 
 func (s SiteConfig) KeyRequired() bool {
@@ -131,3 +440,27 @@ func (s SiteConfig) ValidKey(key string) bool {
 	}
 	return false
 }
+
+// public addresses, and anything in FetchAllowedNetworks
+// (whose entries have already been checked at startup)
+func (s SiteConfig) FetchableIP(ip net.IP) bool {
+	for _, cidr := range s.FetchAllowedNetworks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return publicIP(ip)
+}
+
+// "*" in FetchContentTypes lets anything through and leaves
+// it to the content sniffing to decide
+func (s SiteConfig) FetchableContentType(content_type string) bool {
+	mimetype := strings.TrimSpace(strings.Split(content_type, ";")[0])
+	for _, t := range s.FetchContentTypes {
+		if t == "*" || strings.EqualFold(t, mimetype) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -42,3 +43,56 @@ func Test_ValidKey(t *testing.T) {
 		t.Error("key does exist now")
 	}
 }
+
+func Test_FetchableContentType(t *testing.T) {
+	s := ConfigData{}.MyConfig()
+	if !s.FetchableContentType("image/jpeg") {
+		t.Error("jpeg should be allowed by default")
+	}
+	if !s.FetchableContentType("image/PNG; charset=binary") {
+		t.Error("parameters and case shouldn't matter")
+	}
+	if s.FetchableContentType("text/html") {
+		t.Error("html should not be allowed by default")
+	}
+	s.FetchContentTypes = []string{"*"}
+	if !s.FetchableContentType("application/octet-stream") {
+		t.Error("* should allow anything")
+	}
+}
+
+func Test_Limits(t *testing.T) {
+	s := ConfigData{}.MyConfig()
+	l := s.Limits()
+	if l.MaxBytes < 1 || l.MaxPixels < 1 {
+		t.Error("bytes and pixels should always be limited")
+	}
+	if l.MaxWidth != 0 || l.MaxHeight != 0 {
+		t.Error("dimensions are unlimited by default")
+	}
+}
+
+func Test_DirectoryList(t *testing.T) {
+	var c ConfigData
+	err := json.Unmarshal([]byte(`{"UploadDirectory": "uploads"}`), &c)
+	if err != nil || len(c.UploadDirectory) != 1 {
+		t.Fatal("couldn't parse a single directory")
+	}
+	err = json.Unmarshal([]byte(`{"UploadDirectory": ["/sata1/uploads/", "/sata2/uploads"]}`), &c)
+	if err != nil || len(c.UploadDirectory) != 2 {
+		t.Fatal("couldn't parse a list of directories")
+	}
+	s := c.MyConfig()
+	if s.UploadDirectories[1] != "/sata2/uploads/" {
+		t.Error("trailing slash should be added")
+	}
+	if s.UploadDirectory != "/sata1/uploads/" {
+		t.Error("first directory should be the main one")
+	}
+	if s.PackDirectory != "/sata1/uploads/packs/" {
+		t.Error("packs belong in the main directory")
+	}
+	if json.Unmarshal([]byte(`{"UploadDirectory": 5}`), &c) == nil {
+		t.Error("should reject anything else")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the original layout: a directory per hash, split up two
+// characters at a time, holding full.<ext>, one file per
+// derivative (<size>.<ext>) and the metadata sidecar.
+type DiskStore struct {
+	Root string
+}
+
+func NewDiskStore(root string) *DiskStore {
+	return &DiskStore{Root: root}
+}
+
+func (d DiskStore) dir(hash *Hash) string {
+	return d.Root + hash.AsPath()
+}
+
+func (d DiskStore) path(ri *ImageSpecifier) string {
+	return ri.sizedPath(d.Root)
+}
+
+func (d DiskStore) Put(ri *ImageSpecifier, r io.Reader) error {
+	var expected *Hash
+	if ri.Size.IsFull() {
+		expected = ri.Hash
+	}
+	return writeFileAtomic(d.path(ri), r, expected)
+}
+
+func (d DiskStore) Get(ri *ImageSpecifier) (io.ReadCloser, error) {
+	return os.Open(d.path(ri))
+}
+
+func (d DiskStore) Stat(ri *ImageSpecifier) (int64, error) {
+	fi, err := os.Stat(d.path(ri))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (d DiskStore) Entries(hash *Hash) ([]*ImageSpecifier, error) {
+	files, err := ioutil.ReadDir(d.dir(hash))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*ImageSpecifier, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		// temp files from writeFileAtomic all start with a dot
+		if f.IsDir() || name == metadataFilename || strings.HasPrefix(name, ".") {
+			continue
+		}
+		entries = append(entries, specifierFromFilename(hash, name))
+	}
+	return entries, nil
+}
+
+// each hash algorithm has its own tree, and hash order across
+// them means going through them side by side
+func (d DiskStore) List(after string, fn func(ri *ImageSpecifier) error) error {
+	var walks []walker
+	for algorithm := range hashLengths {
+		root := d.Root + hashPathPrefix(algorithm)
+		walks = append(walks, func(fn func(ri *ImageSpecifier) error) error {
+			return d.walk(root, after, fn)
+		})
+	}
+	return mergeWalks(walks, fn)
+}
+
+// filepath.Walk goes in lexical order, which for our layout is hash
+// order, so whole subtrees before the cursor can be skipped without
+// looking inside them. Anything that isn't part of the hash layout
+// (the other algorithms' trees, packs) is skipped too.
+func (d DiskStore) walk(root, after string, fn func(ri *ImageSpecifier) error) error {
+	err := filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if f.IsDir() {
+			prefix := strings.Replace(strings.TrimPrefix(path, root), "/", "", -1)
+			if !isHex(prefix) {
+				return filepath.SkipDir
+			}
+			if after != "" && len(prefix) < len(after) && prefix < after[:len(prefix)] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isOriginal(path, f) {
+			return nil
+		}
+		hash, err := HashFromPath(path)
+		if err != nil || hash.String() <= after {
+			return nil
+		}
+		return fn(originalSpecifier(hash, filepath.Ext(path)))
+	})
+	return err
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// the only File methods that we care about
+// makes it easier to mock
+type FileIsh interface {
+	IsDir() bool
+	Name() string
+}
+
+// whether a file found while walking the upload
+// directory is the "full" version of an image
+func isOriginal(path string, f FileIsh) bool {
+	return !f.IsDir() && basename(path) == "full" && len(filepath.Ext(path)) > 1
+}
+
+func (d DiskStore) Delete(ri *ImageSpecifier) error {
+	return os.Remove(d.path(ri))
+}
+
+func (d DiskStore) DeleteAll(hash *Hash) error {
+	// a bad hash here could take out far more than one image
+	dir := filepath.Clean(d.dir(hash))
+	root := filepath.Clean(d.Root)
+	if !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		return errors.New(fmt.Sprintf("refusing to delete %s: not under %s", dir, root))
+	}
+	return os.RemoveAll(dir)
+}
+
+func (d DiskStore) GetMetadata(hash *Hash) (*ImageMetadata, error) {
+	b, err := ioutil.ReadFile(d.dir(hash) + "/" + metadataFilename)
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadata(b)
+}
+
+func (d DiskStore) PutMetadata(hash *Hash, m ImageMetadata) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.dir(hash)+"/"+metadataFilename, bytes.NewReader(b), nil)
+}
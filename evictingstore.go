@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keeps the derivatives in the Store underneath it under a byte
+// budget, throwing out whichever was least recently read once it
+// goes over. They can always be made again from the original,
+// which is never evicted (or even counted). A budget of zero
+// never evicts anything, but still keeps count.
+type EvictingStore struct {
+	Store
+	budget int64
+	sl     Logger
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+	bytes   int64
+	// what it's been up to, for the status page
+	evictions    int64
+	evictedBytes int64
+	lastEviction time.Time
+}
+
+type lruEntry struct {
+	ri   *ImageSpecifier
+	size int64
+}
+
+type EvictionStats struct {
+	Budget       int64
+	Bytes        int64
+	Derivatives  int
+	Evictions    int64
+	EvictedBytes int64
+	LastEviction time.Time
+}
+
+// for the status page
+func (s EvictionStats) BytesString() string   { return humanBytes(uint64(s.Bytes)) }
+func (s EvictionStats) EvictedString() string { return humanBytes(uint64(s.EvictedBytes)) }
+
+func (s EvictionStats) BudgetString() string {
+	if s.Budget == 0 {
+		return "unlimited"
+	}
+	return humanBytes(uint64(s.Budget))
+}
+
+func NewEvictingStore(st Store, budget int64, sl Logger) *EvictingStore {
+	return &EvictingStore{
+		Store:   st,
+		budget:  budget,
+		sl:      sl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (e *EvictingStore) Put(ri *ImageSpecifier, r io.Reader) error {
+	if ri.Size.IsFull() {
+		return e.Store.Put(ri, r)
+	}
+	cr := &countingReader{r: r}
+	err := e.Store.Put(ri, cr)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.add(ri, cr.n, true)
+	victims := e.overBudget()
+	e.mu.Unlock()
+	e.evict(victims)
+	return nil
+}
+
+func (e *EvictingStore) Get(ri *ImageSpecifier) (io.ReadCloser, error) {
+	r, err := e.Store.Get(ri)
+	if err == nil && !ri.Size.IsFull() {
+		e.mu.Lock()
+		if el, ok := e.entries[ri.String()]; ok {
+			e.lru.MoveToFront(el)
+		}
+		e.mu.Unlock()
+	}
+	return r, err
+}
+
+func (e *EvictingStore) Delete(ri *ImageSpecifier) error {
+	e.mu.Lock()
+	e.remove(ri.String())
+	e.mu.Unlock()
+	return e.Store.Delete(ri)
+}
+
+func (e *EvictingStore) DeleteAll(hash *Hash) error {
+	e.mu.Lock()
+	prefix := hash.String() + "/"
+	for key := range e.entries {
+		if strings.HasPrefix(key, prefix) {
+			e.remove(key)
+		}
+	}
+	e.mu.Unlock()
+	return e.Store.DeleteAll(hash)
+}
+
+// fresh ones go at the front, ones found by Scan at the back
+// since we have no idea when they were last used.
+// must hold e.mu
+func (e *EvictingStore) add(ri *ImageSpecifier, size int64, fresh bool) {
+	if el, ok := e.entries[ri.String()]; ok {
+		if !fresh {
+			return
+		}
+		e.bytes -= el.Value.(*lruEntry).size
+		e.lru.Remove(el)
+	}
+	entry := &lruEntry{ri, size}
+	if fresh {
+		e.entries[ri.String()] = e.lru.PushFront(entry)
+	} else {
+		e.entries[ri.String()] = e.lru.PushBack(entry)
+	}
+	e.bytes += size
+}
+
+// must hold e.mu
+func (e *EvictingStore) remove(key string) {
+	if el, ok := e.entries[key]; ok {
+		e.bytes -= el.Value.(*lruEntry).size
+		e.lru.Remove(el)
+		delete(e.entries, key)
+	}
+}
+
+// takes entries off the back until we're within budget.
+// must hold e.mu
+func (e *EvictingStore) overBudget() []*lruEntry {
+	var victims []*lruEntry
+	for e.budget > 0 && e.bytes > e.budget && e.lru.Len() > 0 {
+		entry := e.lru.Back().Value.(*lruEntry)
+		e.remove(entry.ri.String())
+		victims = append(victims, entry)
+	}
+	return victims
+}
+
+// the actual deleting happens without the lock held
+func (e *EvictingStore) evict(victims []*lruEntry) {
+	for _, v := range victims {
+		err := e.Store.Delete(v.ri)
+		if err != nil {
+			e.sl.Warning(fmt.Sprintf("couldn't evict %s: %s", v.ri.String(), err))
+			continue
+		}
+		e.mu.Lock()
+		e.evictions++
+		e.evictedBytes += v.size
+		e.lastEviction = time.Now()
+		e.mu.Unlock()
+	}
+	if len(victims) > 0 {
+		e.sl.Info(fmt.Sprintf("evicted %d derivatives to stay under budget", len(victims)))
+	}
+}
+
+// finds the derivatives that were already there at startup
+// and brings the store down to budget if it's over.
+// run this as a goroutine
+func (e *EvictingStore) Scan() {
+	e.sl.Info("scanning for derivatives")
+	e.Store.List("", func(ri *ImageSpecifier) error {
+		entries, err := e.Store.Entries(ri.Hash)
+		if err != nil {
+			return nil
+		}
+		for _, d := range entries {
+			if d.Size.IsFull() {
+				continue
+			}
+			size, err := e.Store.Stat(d)
+			if err != nil {
+				continue
+			}
+			e.mu.Lock()
+			e.add(d, size, false)
+			e.mu.Unlock()
+		}
+		return nil
+	})
+	e.mu.Lock()
+	victims := e.overBudget()
+	e.mu.Unlock()
+	e.evict(victims)
+	e.sl.Info("finished scanning for derivatives")
+}
+
+func (e *EvictingStore) Stats() EvictionStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return EvictionStats{
+		Budget:       e.budget,
+		Bytes:        e.bytes,
+		Derivatives:  e.lru.Len(),
+		Evictions:    e.evictions,
+		EvictedBytes: e.evictedBytes,
+		LastEviction: e.lastEviction,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/thraxil/resize"
+)
+
+func Test_EvictingStore(t *testing.T) {
+	storeConformance(t, NewEvictingStore(NewMemoryStore(), 0, DummyLogger{}))
+	storeConformance(t, NewEvictingStore(NewMemoryStore(), 100, DummyLogger{}))
+}
+
+func Test_EvictingStoreLRU(t *testing.T) {
+	e := NewEvictingStore(NewMemoryStore(), 10, DummyLogger{})
+	img, err := ingestImage(e, bytes.NewReader(encodedTestImage("png", 20, 20)), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sized := func(size string) *ImageSpecifier {
+		return &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec(size), Extension: ".png"}
+	}
+	a, b, c := sized("10s"), sized("20s"), sized("30s")
+	e.Put(a, bytes.NewReader([]byte("aaaa")))
+	e.Put(b, bytes.NewReader([]byte("bbbb")))
+	// a is now more recent than b
+	readAll(e, a)
+	e.Put(c, bytes.NewReader([]byte("cccc")))
+
+	if _, err := e.Stat(b); !os.IsNotExist(err) {
+		t.Error("least recently used derivative should have been evicted")
+	}
+	for _, ri := range []*ImageSpecifier{a, c, img.original()} {
+		if _, err := e.Stat(ri); err != nil {
+			t.Errorf("%s shouldn't have been evicted", ri.String())
+		}
+	}
+	stats := e.Stats()
+	if stats.Bytes != 8 || stats.Derivatives != 2 || stats.Evictions != 1 || stats.EvictedBytes != 4 {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+	if stats.LastEviction.IsZero() {
+		t.Error("should know when it last evicted")
+	}
+
+	// overwriting counts the new size, not both
+	e.Put(a, bytes.NewReader([]byte("aa")))
+	if e.Stats().Bytes != 6 {
+		t.Error("replaced derivative counted twice")
+	}
+	e.Delete(c)
+	if e.Stats().Bytes != 2 {
+		t.Error("deleted derivative still counted")
+	}
+	e.DeleteAll(img.Hash)
+	if e.Stats().Derivatives != 0 {
+		t.Error("DeleteAll should forget everything for the hash")
+	}
+}
+
+func Test_EvictingStoreScan(t *testing.T) {
+	m := NewMemoryStore()
+	img, _ := ingestImage(m, bytes.NewReader(encodedTestImage("png", 20, 20)), "", "", ImageLimits{})
+	for _, size := range []string{"10s", "20s", "30s"} {
+		m.Put(&ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec(size), Extension: ".png"}, bytes.NewReader([]byte("xxxx")))
+	}
+	e := NewEvictingStore(m, 8, DummyLogger{})
+	e.Scan()
+	stats := e.Stats()
+	if stats.Derivatives != 2 || stats.Bytes != 8 || stats.Evictions != 1 {
+		t.Errorf("wrong stats after scan: %+v", stats)
+	}
+	if _, err := m.Stat(img.original()); err != nil {
+		t.Error("scan should never evict the original")
+	}
+	if stats.BudgetString() != "8 B" || (EvictionStats{}).BudgetString() != "unlimited" {
+		t.Error("wrong budget string")
+	}
+}
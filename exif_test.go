@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/thraxil/resize"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os/exec"
+	"testing"
+)
+
+// a 40x20 jpeg, blue apart from a red top left quadrant,
+// that says it has the given orientation. Odd ones are
+// written big endian, even ones little endian.
+func orientedJPEG(orientation int) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{0, 0, 255, 255}
+			if x < 20 && y < 10 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			m.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, m, &jpeg.Options{Quality: 95})
+
+	var order binary.ByteOrder = binary.BigEndian
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	if orientation%2 == 0 {
+		order = binary.LittleEndian
+		tiff = []byte("II\x2a\x00\x08\x00\x00\x00")
+	}
+	ifd := make([]byte, 2+12+4)
+	order.PutUint16(ifd, 1)
+	order.PutUint16(ifd[2:], exifOrientationTag)
+	order.PutUint16(ifd[4:], 3) // SHORT
+	order.PutUint32(ifd[6:], 1)
+	order.PutUint16(ifd[10:], uint16(orientation))
+	segment := append([]byte("Exif\x00\x00"), append(tiff, ifd...)...)
+
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	jpg := buf.Bytes()
+	return append(append(append([]byte{}, jpg[:2]...), app1...), jpg[2:]...)
+}
+
+func Test_exifOrientation(t *testing.T) {
+	for o := 1; o <= 8; o++ {
+		if got := exifOrientation(orientedJPEG(o)); got != o {
+			t.Errorf("expected orientation %d, got %d", o, got)
+		}
+	}
+	for _, data := range [][]byte{
+		nil,
+		encodedTestImage("jpg", 10, 10),
+		encodedTestImage("png", 10, 10),
+		orientedJPEG(6)[:30],
+		orientedJPEG(9),
+	} {
+		if exifOrientation(data) != 1 {
+			t.Error("should have been treated as upright")
+		}
+	}
+}
+
+// which corner of the upright image the stored top left one ends up in
+var orientedCorners = map[int]string{
+	1: "top left", 2: "top right", 3: "bottom right", 4: "bottom left",
+	5: "top left", 6: "top right", 7: "bottom right", 8: "bottom left",
+}
+
+func redCorner(t *testing.T, img image.Image) string {
+	b := img.Bounds()
+	corners := map[string]image.Point{
+		"top left":     {b.Min.X + b.Dx()/4, b.Min.Y + b.Dy()/4},
+		"top right":    {b.Min.X + b.Dx()*3/4, b.Min.Y + b.Dy()/4},
+		"bottom left":  {b.Min.X + b.Dx()/4, b.Min.Y + b.Dy()*3/4},
+		"bottom right": {b.Min.X + b.Dx()*3/4, b.Min.Y + b.Dy()*3/4},
+	}
+	found := ""
+	for name, p := range corners {
+		r, _, bl, _ := img.At(p.X, p.Y).RGBA()
+		if r > bl {
+			if found != "" {
+				t.Errorf("red in both %s and %s", found, name)
+			}
+			found = name
+		}
+	}
+	return found
+}
+
+func Test_orient(t *testing.T) {
+	for o := 1; o <= 8; o++ {
+		img, _ := jpeg.Decode(bytes.NewReader(orientedJPEG(o)))
+		upright := orient(img, o)
+		b := upright.Bounds()
+		if o >= 5 && (b.Dx() != 20 || b.Dy() != 40) {
+			t.Errorf("orientation %d should have come out 20x40, not %dx%d", o, b.Dx(), b.Dy())
+		}
+		if o < 5 && (b.Dx() != 40 || b.Dy() != 20) {
+			t.Errorf("orientation %d shouldn't have changed size", o)
+		}
+		if corner := redCorner(t, upright); corner != orientedCorners[o] {
+			t.Errorf("orientation %d: red ended up %s, not %s", o, corner, orientedCorners[o])
+		}
+	}
+}
+
+// every orientation at every kind of size, through whichever
+// engine resizeTo uses
+func checkOrientations(t *testing.T, resizeTo func(ri *ImageSpecifier, st Store) (image.Image, error)) {
+	var sizes = []struct {
+		Size string
+		// for landscape (1-4) and portrait (5-8) results
+		Landscape, Portrait image.Point
+	}{
+		{"10w", image.Pt(10, 5), image.Pt(10, 20)},
+		{"10h", image.Pt(20, 10), image.Pt(5, 10)},
+		{"16x16", image.Pt(16, 8), image.Pt(8, 16)},
+		{"8s", image.Pt(8, 8), image.Pt(8, 8)},
+	}
+	for o := 1; o <= 8; o++ {
+		st, ri := resizeTestStore(t, "jpg", orientedJPEG(o))
+		for _, size := range sizes {
+			ri.Size = resize.MakeSizeSpec(size.Size)
+			img, err := resizeTo(ri, st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := size.Landscape
+			if o >= 5 {
+				expected = size.Portrait
+			}
+			if img.Bounds().Size() != expected {
+				t.Errorf("orientation %d at %s came out %v, not %v", o, size.Size, img.Bounds().Size(), expected)
+			}
+			// squares only keep the middle, which
+			// still has a bit of the red quadrant
+			if corner := redCorner(t, img); corner != orientedCorners[o] {
+				t.Errorf("orientation %d at %s: red ended up %s, not %s", o, size.Size, corner, orientedCorners[o])
+			}
+		}
+	}
+}
+
+func Test_resizeNativeOrientations(t *testing.T) {
+	s := ConfigData{Writeable: true}.MyConfig()
+	checkOrientations(t, func(ri *ImageSpecifier, st Store) (image.Image, error) {
+		return resizeNative(ri, st, &s)
+	})
+}
+
+// the same again with the real convert, which has to
+// agree with the native engine about which way is up
+func Test_resizeWithImageMagickOrientations(t *testing.T) {
+	convert, err := exec.LookPath("convert")
+	if err != nil {
+		t.Skip("imagemagick's convert isn't installed")
+	}
+	s := ConfigData{Writeable: true, ImageMagickConvertPath: convert}.MyConfig()
+	checkOrientations(t, func(ri *ImageSpecifier, st Store) (image.Image, error) {
+		if err := resizeWithImageMagick(ri, st, DummyLogger{}, &s); err != nil {
+			return nil, err
+		}
+		data, err := readAll(st, ri)
+		if err != nil {
+			return nil, err
+		}
+		return jpeg.Decode(bytes.NewReader(data))
+	})
+}
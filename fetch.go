@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// addresses that aren't out on the internet: loopback, private
+// and link-local ranges (which is where cloud metadata services
+// live), and so on. /fetch/ stays away from them unless they're
+// in FetchAllowedNetworks, so it can't be used to reach things
+// only this node can.
+var nonPublicNetworks = parseNetworks([]string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+})
+
+func parseNetworks(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+func publicIP(ip net.IP) bool {
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// what the dialer says when it won't connect somewhere
+var errFetchForbidden = errors.New("address not allowed")
+
+// checks each address once it's been looked up, just before
+// connecting, so a hostname (or a redirect) can't get around
+// it by resolving to somewhere it shouldn't
+func fetchDialControl(s SiteConfig) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !s.FetchableIP(ip) {
+			return errFetchForbidden
+		}
+		return nil
+	}
+}
+
+// downloads source into a temp file so it can go through the
+// same ingest path as an upload. Size, time, redirects and
+// content type are all limited by the config. The caller is
+// responsible for closing and removing the file.
+func fetchImage(source string, s SiteConfig) (*os.File, error) {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, uploadError{400, "invalid url"}
+	}
+	dialer := &net.Dialer{
+		Timeout: time.Duration(s.FetchTimeout) * time.Second,
+		Control: fetchDialControl(s),
+	}
+	client := &http.Client{
+		// no proxy, since that would be what got checked
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		Timeout:   time.Duration(s.FetchTimeout) * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > s.FetchMaxRedirects {
+				// hand back the redirect itself, which
+				// then gets rejected as a non-200
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		if errors.Is(err, errFetchForbidden) {
+			return nil, uploadError{403, "not allowed to fetch from that address"}
+		}
+		if ue, ok := err.(*url.Error); ok && ue.Timeout() {
+			return nil, uploadError{504, "timed out fetching image"}
+		}
+		return nil, uploadError{502, fmt.Sprintf("could not fetch image: %s", err.Error())}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, uploadError{502, fmt.Sprintf("source returned %s", resp.Status)}
+	}
+	if !s.FetchableContentType(resp.Header.Get("Content-Type")) {
+		return nil, uploadError{415, fmt.Sprintf("source has content type %q",
+			resp.Header.Get("Content-Type"))}
+	}
+	if resp.ContentLength > s.FetchMaxBytes {
+		return nil, uploadError{413, "source image is too large"}
+	}
+
+	f, err := ioutil.TempFile("", "reticulum-fetch-")
+	if err != nil {
+		return nil, err
+	}
+	// read one byte past the limit so we can tell
+	// when a server lied about (or left off) Content-Length
+	n, err := io.Copy(f, io.LimitReader(resp.Body, s.FetchMaxBytes+1))
+	if err == nil && n > s.FetchMaxBytes {
+		err = uploadError{413, "source image is too large"}
+	} else if err != nil {
+		err = uploadError{502, fmt.Sprintf("error reading source image: %s", err.Error())}
+	}
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
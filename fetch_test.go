@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// the test servers are all on loopback
+func fetchTestConfig() SiteConfig {
+	return ConfigData{FetchMaxBytes: 1 << 20, FetchAllowedNetworks: []string{"127.0.0.0/8"}}.MyConfig()
+}
+
+func fetchStatus(err error) int {
+	if ue, ok := err.(uploadError); ok {
+		return ue.Status
+	}
+	return 0
+}
+
+func Test_fetchImage(t *testing.T) {
+	png := encodedTestImage("png", 10, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		case "/big.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(make([]byte, 2<<20))
+		case "/redirect":
+			http.Redirect(w, r, "/image.png", 302)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	s := fetchTestConfig()
+	f, err := fetchImage(ts.URL+"/image.png", s)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	b, _ := ioutil.ReadAll(f)
+	f.Close()
+	os.Remove(f.Name())
+	if len(b) != len(png) {
+		t.Error("didn't get the whole image")
+	}
+
+	_, err = fetchImage(ts.URL+"/page.html", s)
+	if fetchStatus(err) != 415 {
+		t.Error("html should have been rejected as 415")
+	}
+	_, err = fetchImage(ts.URL+"/big.png", s)
+	if fetchStatus(err) != 413 {
+		t.Error("oversized image should have been a 413")
+	}
+	_, err = fetchImage(ts.URL+"/missing.png", s)
+	if fetchStatus(err) != 502 {
+		t.Error("missing image should have been a 502")
+	}
+	_, err = fetchImage("ftp://example.com/image.png", s)
+	if fetchStatus(err) != 400 {
+		t.Error("non-http url should have been a 400")
+	}
+
+	_, err = fetchImage(ts.URL+"/redirect", s)
+	if err == nil {
+		t.Error("redirects aren't followed by default")
+	}
+	s.FetchMaxRedirects = 1
+	f, err = fetchImage(ts.URL+"/redirect", s)
+	if err != nil {
+		t.Errorf("should have followed the redirect: %s", err)
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func Test_fetchImageNonPublic(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// straight to the metadata service
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", 302)
+	}))
+	defer ts.Close()
+
+	s := ConfigData{FetchMaxRedirects: 1}.MyConfig()
+	_, err := fetchImage(ts.URL+"/image.png", s)
+	if fetchStatus(err) != 403 {
+		t.Errorf("loopback should be off limits by default: %v", err)
+	}
+	s.FetchAllowedNetworks = []string{"127.0.0.1/32"}
+	_, err = fetchImage(ts.URL+"/image.png", s)
+	if fetchStatus(err) != 403 {
+		t.Errorf("redirects should be checked as well: %v", err)
+	}
+}
+
+func Test_FetchableIP(t *testing.T) {
+	s := ConfigData{FetchAllowedNetworks: []string{"10.1.0.0/16"}}.MyConfig()
+	for _, c := range []struct {
+		ip        string
+		fetchable bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"::ffff:169.254.169.254", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+	} {
+		if s.FetchableIP(net.ParseIP(c.ip)) != c.fetchable {
+			t.Errorf("%s should be fetchable: %v", c.ip, c.fetchable)
+		}
+	}
+}
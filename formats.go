@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// what imagemagick calls each of the formats we serve
+var magickFormats = map[string]string{
+	"jpg":  "JPEG",
+	"png":  "PNG",
+	"gif":  "GIF",
+	"webp": "WEBP",
+	"avif": "AVIF",
+}
+
+// the formats that imagemagick says it can write, from the output
+// of convert -list format, which looks like
+//
+//	   Format  Module    Mode  Description
+//	-------------------------------------------------
+//	     AVIF* HEIC      rw+   AV1 Image File Format (1.12.0)
+//	     WEBP* WEBP      rw+   WebP Image Format (libwebp 1.2.4)
+//
+// older versions leave out the Module column.
+func parseFormatList(list string) map[string]bool {
+	writeable := make(map[string]bool)
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name := strings.TrimRight(fields[0], "*")
+		for _, mode := range fields[1:] {
+			if len(mode) == 3 && strings.Trim(mode, "rw+-") == "" {
+				writeable[name] = mode[1] == 'w'
+				break
+			}
+		}
+	}
+	return writeable
+}
+
+// which of the formats we serve this node can make. The ones Go
+// writes itself are always there; the rest depend on whether
+// the local convert was built with support for them.
+func probeOutputFormats(s *SiteConfig, sl Logger) []string {
+	var formats []string
+	for ext := range extencoders {
+		formats = append(formats, strings.TrimPrefix(ext, "."))
+	}
+	var out bytes.Buffer
+	err := runConvert([]string{s.ImageMagickConvertPath, "-list", "format"}, s, sl, &out)
+	if err != nil {
+		sl.Warning(fmt.Sprintf("couldn't ask imagemagick what it can write: %s", err.Error()))
+	}
+	writeable := parseFormatList(out.String())
+	for ext := range extmimes {
+		if extencoders["."+ext] == nil && writeable[magickFormats[ext]] {
+			formats = append(formats, ext)
+		}
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// jpg is the only format we serve that can't
+// have anything see-through in it
+func keepsTransparency(ext string) bool {
+	return ext != ".jpg"
+}
+
+// puts img on a solid background, for formats
+// without transparency
+func flatten(img image.Image, bg color.Color) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
+
+// "#rrggbb" or "#rgb", as in css (and imagemagick)
+func parseHexColor(s string) (color.RGBA, error) {
+	c := color.RGBA{A: 255}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 || !strings.HasPrefix(s, "#") {
+		return c, errors.New(fmt.Sprintf("invalid colour: %q", s))
+	}
+	c.R, c.G, c.B = uint8(v>>16), uint8(v>>8), uint8(v)
+	return c, nil
+}
+
+// whether this node can make derivatives in the format ext
+// (with its leading dot). Nodes too old to say can make the
+// formats that originals come in, and nothing else.
+func (n NodeData) CanMake(ext string) bool {
+	if originalFormat(ext) {
+		return true
+	}
+	ext = strings.TrimPrefix(ext, ".")
+	for _, f := range n.OutputFormats {
+		if f == ext {
+			return true
+		}
+	}
+	return false
+}
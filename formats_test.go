@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const im7FormatList = `   Format  Module    Mode  Description
+-------------------------------------------------------------------------------
+      3FR  DNG       r--   Hasselblad CFV/H3D39II Raw Format (0.21.1-Release)
+     AVIF* HEIC      rw+   AV1 Image File Format (1.17.6)
+      GIF* GIF       rw+   CompuServe graphics interchange format
+     JPEG* JPEG      rw-   Joint Photographic Experts Group JFIF format (80)
+      PNG* PNG       rw-   Portable Network Graphics (libpng 1.6.43)
+     WEBP* WEBP      r--   WebP Image Format (libwebp 1.3.2 [020F])
+
+* native blob support
+r read support
+w write support
++ support for multiple images`
+
+const im6FormatList = `   Format  Mode  Description
+-------------------------------------------------------------------------------
+      GIF* rw+   CompuServe graphics interchange format
+     WEBP* rw-   WebP Image Format (libwebp 0.6.1[0209])`
+
+func Test_parseFormatList(t *testing.T) {
+	formats := parseFormatList(im7FormatList)
+	for name, expected := range map[string]bool{"AVIF": true, "GIF": true, "WEBP": false, "3FR": false} {
+		if formats[name] != expected {
+			t.Errorf("%s should be writeable: %v", name, expected)
+		}
+	}
+	if !parseFormatList(im6FormatList)["WEBP"] {
+		t.Error("should understand older versions too")
+	}
+	if len(parseFormatList("")) != 0 {
+		t.Error("nothing to parse")
+	}
+}
+
+func Test_probeOutputFormats(t *testing.T) {
+	convert, cleanup := fakeConvert(t, "cat <<'EOF'\n"+im7FormatList+"\nEOF")
+	defer cleanup()
+	s := ConfigData{ImageMagickConvertPath: convert}.MyConfig()
+	if formats := strings.Join(probeOutputFormats(&s, DummyLogger{}), ","); formats != "avif,gif,jpg,png" {
+		t.Errorf("wrong formats: %s", formats)
+	}
+	s.ImageMagickConvertPath = "/nonexistent/convert"
+	if formats := strings.Join(probeOutputFormats(&s, DummyLogger{}), ","); formats != "gif,jpg,png" {
+		t.Errorf("should still have the native formats without imagemagick: %s", formats)
+	}
+}
+
+func Test_CanMake(t *testing.T) {
+	n := NodeData{}
+	if !n.CanMake(".jpg") || n.CanMake(".webp") {
+		t.Error("nodes that don't say should only make the original formats")
+	}
+	n.OutputFormats = []string{"gif", "jpg", "png", "avif"}
+	if !n.CanMake(".avif") || n.CanMake(".webp") {
+		t.Error("should go by what the node says")
+	}
+}
+
+func Test_AdvertiseFormats(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	ctx.Cluster.Myself.OutputFormats = []string{"gif", "jpg", "png", "webp"}
+
+	w := httptest.NewRecorder()
+	ConfigHandler(w, httptest.NewRequest("GET", "/config/", nil), ctx)
+	if !strings.Contains(w.Body.String(), `"output_formats":["gif","jpg","png","webp"]`) {
+		t.Errorf("should advertise formats: %s", w.Body.String())
+	}
+
+	n := NodeData{Nickname: "other", UUID: "other-uuid", BaseUrl: "localhost:8081", OutputFormats: []string{"avif", "jpg"}}
+	r := httptest.NewRequest("POST", "/announce/", strings.NewReader(makeParams(n).Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	AnnounceHandler(w, r, ctx)
+	if !strings.Contains(w.Body.String(), `"output_formats":["gif","jpg","png","webp"]`) {
+		t.Errorf("should tell them what we can make: %s", w.Body.String())
+	}
+	nd, ok := ctx.Cluster.FindNeighborByUUID("other-uuid")
+	if !ok || !nd.CanMake(".avif") {
+		t.Error("didn't record what the new neighbor can make")
+	}
+
+	// we have the original, but can't make avif from it
+	img, err := ctx.ingest(bytes.NewReader(encodedTestImage("png", 30, 20)), "", ImageMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	RetrieveHandler(w, httptest.NewRequest("GET", "/retrieve/"+img.Hash.String()+"/10s/avif/", nil), ctx)
+	if w.Code != 404 || !strings.Contains(w.Body.String(), "could not resize") {
+		t.Errorf("expected a 404, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_parseHexColor(t *testing.T) {
+	for s, expected := range map[string]color.RGBA{
+		"#ffffff": {255, 255, 255, 255},
+		"#102030": {16, 32, 48, 255},
+		"#f00":    {255, 0, 0, 255},
+	} {
+		if c, err := parseHexColor(s); err != nil || c != expected {
+			t.Errorf("%s came out %v", s, c)
+		}
+	}
+	for _, s := range []string{"", "ffffff", "#ffff", "#gggggg", "#fffffff"} {
+		if _, err := parseHexColor(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+// half transparent, half opaque green
+func transparentPNG() []byte {
+	m := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 10; x < 20; x++ {
+			m.Set(x, y, color.NRGBA{0, 255, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, m)
+	return buf.Bytes()
+}
+
+func Test_resizeNativeConversions(t *testing.T) {
+	s := ConfigData{Writeable: true, FlattenBackground: "#f00"}.MyConfig()
+	st, ri := resizeTestStore(t, "png", transparentPNG())
+
+	ri.Extension = ".jpg"
+	img, err := resizeNative(ri, st, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameColor(img.At(2, 2), color.RGBA{255, 0, 0, 255}) || !sameColor(img.At(8, 2), color.RGBA{0, 255, 0, 255}) {
+		t.Error("transparent parts should have been put on the background")
+	}
+	ri.Extension = ".gif"
+	img, _ = resizeNative(ri, st, &s)
+	if _, _, _, a := img.At(2, 2).RGBA(); a != 0 {
+		t.Error("formats with transparency should keep it")
+	}
+
+	// animations turn into their first frame
+	st, ri = resizeTestStore(t, "gif", animatedGIF())
+	ri.Extension = ".png"
+	img, err = resizeNative(ri, st, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, animated := img.(*animation); animated || !sameColor(img.At(8, 4), animationPalette[0]) {
+		t.Error("should have been the first frame, on its own")
+	}
+
+	s.FlattenBackground = "white"
+	ri.Extension = ".jpg"
+	if _, err := resizeNative(ri, st, &s); err == nil {
+		t.Error("should have failed on a bad background")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+
 	"github.com/golang/groupcache"
 )
 
@@ -16,6 +18,9 @@ func (g *GroupCacheProxy) MakeCache(c *Cluster, size int64) CacheGetter {
 			func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
 				// get image from disk
 				ri := NewImageSpecifier(key)
+				if c.Tombstoned(ri.Hash.String()) {
+					return errors.New("image has been deleted")
+				}
 				img_data, err := c.RetrieveImage(ri)
 				if err != nil {
 					return err
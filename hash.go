@@ -2,8 +2,11 @@ package main
 
 import (
 	_ "bytes"
+	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"path/filepath"
 	"strings"
 )
@@ -13,9 +16,52 @@ type Hash struct {
 	Value     []byte
 }
 
+// what new uploads get addressed by, unless configured otherwise.
+// sha1 is still understood everywhere, for everything
+// uploaded before.
+const defaultHashAlgorithm = "sha256"
+
+// length of the hex digest for each algorithm we know. they're
+// all different, so the length alone says which one a hash is.
+var hashLengths = map[string]int{
+	"sha1":   40,
+	"sha256": 64,
+}
+
+func knownHashAlgorithm(algorithm string) bool {
+	_, ok := hashLengths[algorithm]
+	return ok
+}
+
+func algorithmForLength(n int) (string, bool) {
+	for algorithm, length := range hashLengths {
+		if length == n {
+			return algorithm, true
+		}
+	}
+	return "", false
+}
+
+// sha1 images live straight under the upload directory, as they
+// always have. anything newer gets its own subdirectory so the
+// two layouts never get mixed up.
+func hashPathPrefix(algorithm string) string {
+	if algorithm == "sha1" {
+		return ""
+	}
+	return algorithm + "/"
+}
+
+// the directory parts of the path have to end with the
+// hash, split up two characters at a time
 func HashFromPath(path string) (*Hash, error) {
 	dir := filepath.Dir(path)
 	parts := strings.Split(dir, "/")
+	// the longer layouts have to be tried first, since
+	// the tail end of one looks like a shorter one
+	if len(parts) > 32 && parts[len(parts)-33] == "sha256" {
+		return HashFromString(strings.Join(parts[len(parts)-32:], ""), "sha256")
+	}
 	// only want the last 20 parts
 	if len(parts) < 20 {
 		return nil, errors.New("not enough parts")
@@ -27,11 +73,19 @@ func HashFromPath(path string) (*Hash, error) {
 	return HashFromString(hash, "sha1")
 }
 
+// with no algorithm given, it's worked out from the length.
+// Upper case is fine, but it's always lower case after this
 func HashFromString(str, algorithm string) (*Hash, error) {
+	str = strings.ToLower(str)
 	if algorithm == "" {
-		algorithm = "sha1"
+		var ok bool
+		algorithm, ok = algorithmForLength(len(str))
+		if !ok {
+			return nil, errors.New("invalid hash")
+		}
 	}
-	if len(str) != 40 {
+	// it ends up in paths, so nothing but hex
+	if len(str) != hashLengths[algorithm] || !isHex(str) {
 		return nil, errors.New("invalid hash")
 	}
 	return &Hash{algorithm, []byte(str)}, nil
@@ -45,7 +99,26 @@ func (h Hash) AsPath() string {
 			parts = append(parts, s[i-1:i+1])
 		}
 	}
-	return strings.Join(parts, "/")
+	return hashPathPrefix(h.Algorithm) + strings.Join(parts, "/")
+}
+
+func newDigest(algorithm string) hash.Hash {
+	if algorithm == "sha256" {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// a fresh digest of the same kind as h
+func (h Hash) NewDigest() hash.Hash {
+	return newDigest(h.Algorithm)
+}
+
+// whether b is what h is the hash of
+func (h Hash) Matches(b []byte) bool {
+	d := h.NewDigest()
+	d.Write(b)
+	return fmt.Sprintf("%x", d.Sum(nil)) == h.String()
 }
 
 func (h Hash) String() string {
@@ -53,5 +126,6 @@ func (h Hash) String() string {
 }
 
 func (h Hash) Valid() bool {
-	return h.Algorithm == "sha1" && len(h.String()) == 40
+	length, ok := hashLengths[h.Algorithm]
+	return ok && len(h.String()) == length
 }
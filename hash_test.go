@@ -23,6 +23,17 @@ func Test_HashFromString(t *testing.T) {
 	if err == nil {
 		t.Error("non 40 char hash should've been an error")
 	}
+	h, err = HashFromString("........................................", "")
+	if err == nil {
+		t.Error("non hex hash should've been an error")
+	}
+	h, err = HashFromString("AE28605F0FFC34FE5314342F78EFAA13EE45F699", "")
+	if err != nil || h.String() != "ae28605f0ffc34fe5314342f78efaa13ee45f699" {
+		t.Error("upper case hash should resolve to the same one")
+	}
+	if h != nil && h.AsPath() != "ae/28/60/5f/0f/fc/34/fe/53/14/34/2f/78/ef/aa/13/ee/45/f6/99" {
+		t.Error(fmt.Sprintf("upper case hash has the wrong path: %s", h.AsPath()))
+	}
 }
 
 func Test_Valid(t *testing.T) {
@@ -32,7 +43,11 @@ func Test_Valid(t *testing.T) {
 	}
 	h.Algorithm = "foo"
 	if h.Valid() {
-		t.Error("hash should not be valid (only sha1 supported for now)")
+		t.Error("hash should not be valid (unknown algorithm)")
+	}
+	h.Algorithm = "sha256"
+	if h.Valid() {
+		t.Error("hash should not be valid (wrong length for sha256)")
 	}
 }
 
@@ -53,3 +68,31 @@ func Test_HashFromPath(t *testing.T) {
 	}
 
 }
+
+func Test_HashFromStringSHA256(t *testing.T) {
+	s := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	h, err := HashFromString(s, "")
+	if err != nil {
+		t.Fatal("bad hash")
+	}
+	if h.Algorithm != "sha256" || !h.Valid() {
+		t.Error("should have been detected as sha256")
+	}
+	if h.AsPath() != "sha256/9f/86/d0/81/88/4c/7d/65/9a/2f/ea/a0/c5/5a/d0/15/a3/bf/4f/1b/2b/0b/82/2c/d1/5d/6c/15/b0/f0/0a/08" {
+		t.Error(fmt.Sprintf("wrong path: %s", h.AsPath()))
+	}
+	if _, err := HashFromString(s, "sha1"); err == nil {
+		t.Error("wrong length for the algorithm")
+	}
+	p, err := HashFromPath("uploads/" + h.AsPath() + "/full.jpg")
+	if err != nil || p.String() != s || p.Algorithm != "sha256" {
+		t.Error("couldn't get a sha256 hash back from its path")
+	}
+	if !h.Matches([]byte("test")) || h.Matches([]byte("tset")) {
+		t.Error("wrong digest used")
+	}
+	sha1hash, _ := HashFromString("a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", "")
+	if !sha1hash.Matches([]byte("test")) {
+		t.Error("sha1 hashes should still check with sha1")
+	}
+}
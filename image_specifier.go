@@ -2,18 +2,29 @@ package main
 
 import (
 	"github.com/thraxil/resize"
+	"path/filepath"
 	"strings"
 )
 
+// what a static frame's filename has on the end of its size
+const staticSuffix = "-static"
+
 // combination of field that uniquely specify an image
 type ImageSpecifier struct {
 	Hash      *Hash
 	Size      *resize.SizeSpec
 	Extension string
+	// just the first frame of an animated gif. It's a derivative
+	// of its own, stored and cached apart from the animation
+	Static bool
 }
 
 func (i ImageSpecifier) String() string {
-	return i.Hash.String() + "/" + i.Size.String() + "/image" + i.Extension
+	stem := "/image"
+	if i.Static {
+		stem = "/static"
+	}
+	return i.Hash.String() + "/" + i.Size.String() + stem + i.Extension
 }
 
 func NewImageSpecifier(s string) *ImageSpecifier {
@@ -24,11 +35,39 @@ func NewImageSpecifier(s string) *ImageSpecifier {
 	filename := parts[2]
 	fparts := strings.Split(filename, ".")
 	extension := "." + fparts[1]
-	return &ImageSpecifier{Hash: ahash, Size: rs, Extension: extension}
+	static := fparts[0] == "static"
+	return &ImageSpecifier{Hash: ahash, Size: rs, Extension: extension, Static: static}
+}
+
+// the other way from filename()
+func specifierFromFilename(hash *Hash, name string) *ImageSpecifier {
+	ext := filepath.Ext(name)
+	size := strings.TrimSuffix(name, ext)
+	static := strings.HasSuffix(size, staticSuffix)
+	size = strings.TrimSuffix(size, staticSuffix)
+	return &ImageSpecifier{Hash: hash, Size: resize.MakeSizeSpec(size), Extension: ext, Static: static}
+}
+
+// ext includes the leading dot, like everywhere
+// else an ImageSpecifier is made
+func originalSpecifier(hash *Hash, ext string) *ImageSpecifier {
+	return &ImageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("full"), Extension: ext}
+}
+
+func (i ImageSpecifier) fullSize() *ImageSpecifier {
+	return originalSpecifier(i.Hash, i.Extension)
+}
+
+// what the derivative would be called if it were a file
+func (i ImageSpecifier) filename() string {
+	if i.Static {
+		return i.Size.String() + staticSuffix + i.Extension
+	}
+	return i.Size.String() + i.Extension
 }
 
 func (i ImageSpecifier) sizedPath(upload_dir string) string {
-	return resizedPath(i.fullSizePath(upload_dir), i.Size.String())
+	return filepath.Dir(i.fullSizePath(upload_dir)) + "/" + i.filename()
 }
 
 func (i ImageSpecifier) fullSizePath(upload_dir string) string {
@@ -38,7 +77,11 @@ func (i ImageSpecifier) fullSizePath(upload_dir string) string {
 
 func (i ImageSpecifier) retrieveUrlPath() string {
 	ext := strings.TrimLeft(i.Extension, ".")
-	return "/retrieve/" + i.Hash.String() + "/" + i.Size.String() + "/" + ext + "/"
+	path := "/retrieve/" + i.Hash.String() + "/" + i.Size.String() + "/" + ext + "/"
+	if i.Static {
+		path += "?static=true"
+	}
+	return path
 }
 
 func (i ImageSpecifier) retrieveInfoUrlPath() string {
@@ -56,3 +56,28 @@ func Test_RetrieveInfoUrlPath(t *testing.T) {
 		t.Errorf("wrong retreiveInfoUrlPath: %s", r)
 	}
 }
+
+func Test_StaticSpecifier(t *testing.T) {
+	s := "112e42f26fce70d268438ac8137d81607499ee10/200s/static.gif"
+	i := NewImageSpecifier(s)
+	if !i.Static {
+		t.Fatal("should have been the static frame")
+	}
+	if i.String() != s {
+		t.Errorf("incorrect stringification: %s", i.String())
+	}
+	r := i.sizedPath("")
+	if r != "11/2e/42/f2/6f/ce/70/d2/68/43/8a/c8/13/7d/81/60/74/99/ee/10/200s-static.gif" {
+		t.Errorf("wrong sizedPath: %s", r)
+	}
+	if i.retrieveUrlPath() != "/retrieve/112e42f26fce70d268438ac8137d81607499ee10/200s/gif/?static=true" {
+		t.Errorf("wrong retrieveUrlPath: %s", i.retrieveUrlPath())
+	}
+	back := specifierFromFilename(i.Hash, i.filename())
+	if back.String() != s {
+		t.Errorf("didn't come back from its filename: %s", back.String())
+	}
+	if specifierFromFilename(i.Hash, "200s.gif").Static {
+		t.Error("only the static frame is static")
+	}
+}
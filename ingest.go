@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/thraxil/resize"
+)
+
+// an upload we won't take, along with the HTTP status
+// it should be reported with
+type uploadError struct {
+	Status  int
+	Message string
+}
+
+func (e uploadError) Error() string { return e.Message }
+
+// image.DecodeConfig's names for the formats we know how to handle,
+// mapped to the extensions we store them under
+var formatexts = map[string]string{
+	"jpeg": "jpg",
+	"png":  "png",
+	"gif":  "gif",
+}
+
+// figures out what an upload actually is from its magic bytes
+// and headers, ignoring whatever the client claimed it was
+func detectImageFormat(r io.Reader) (string, image.Config, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", cfg, uploadError{415, "not a recognized image"}
+	}
+	ext, ok := formatexts[format]
+	if !ok {
+		return "", cfg, uploadError{415, fmt.Sprintf("unsupported image format: %s", format)}
+	}
+	return ext, cfg, nil
+}
+
+func (l ImageLimits) checkLength(length int64) error {
+	if l.MaxBytes > 0 && length > l.MaxBytes {
+		return uploadError{413, fmt.Sprintf("image is %d bytes; the limit is %d", length, l.MaxBytes)}
+	}
+	return nil
+}
+
+// only needs the headers, so this is safe to run
+// before anything tries to decode the whole image
+func (l ImageLimits) checkDimensions(cfg image.Config) error {
+	if l.MaxWidth > 0 && cfg.Width > l.MaxWidth {
+		return uploadError{413, fmt.Sprintf("image is %d pixels wide; the limit is %d", cfg.Width, l.MaxWidth)}
+	}
+	if l.MaxHeight > 0 && cfg.Height > l.MaxHeight {
+		return uploadError{413, fmt.Sprintf("image is %d pixels high; the limit is %d", cfg.Height, l.MaxHeight)}
+	}
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if l.MaxPixels > 0 && pixels > l.MaxPixels {
+		return uploadError{413, fmt.Sprintf("image is %d pixels; the limit is %d", pixels, l.MaxPixels)}
+	}
+	return nil
+}
+
+// what we know about an original
+type ingestedImage struct {
+	Hash      *Hash
+	Extension string
+	Config    image.Config
+	Length    int64
+	// empty if the image wouldn't decode far enough to work it out
+	PerceptualHash string
+	Metadata       ImageMetadata
+}
+
+// hashes an upload and works out its real format, without writing
+// anything. If expected is non-empty, the upload must hash to it,
+// using whichever algorithm it was made with. Otherwise it's hashed
+// with algorithm (or the default, if that's empty too). Anything
+// over the limits is turned away here.
+func examineUpload(i io.ReadSeeker, expected, algorithm string, limits ImageLimits) (*ingestedImage, error) {
+	if expected != "" {
+		want, err := HashFromString(expected, "")
+		if err != nil {
+			return nil, uploadError{400, "invalid hash"}
+		}
+		algorithm = want.Algorithm
+	}
+	if algorithm == "" {
+		algorithm = defaultHashAlgorithm
+	}
+	h := newDigest(algorithm)
+	length, err := io.Copy(h, i)
+	if err != nil {
+		return nil, uploadError{400, "could not read upload"}
+	}
+	err = limits.checkLength(length)
+	if err != nil {
+		return nil, err
+	}
+	ahash, err := HashFromString(fmt.Sprintf("%x", h.Sum(nil)), algorithm)
+	if err != nil {
+		return nil, uploadError{500, "bad hash"}
+	}
+	if expected != "" && expected != ahash.String() {
+		// got mangled on the way over
+		return nil, uploadError{400, "hash mismatch"}
+	}
+
+	i.Seek(0, 0)
+	ext, cfg, err := detectImageFormat(i)
+	if err != nil {
+		return nil, err
+	}
+	err = limits.checkDimensions(cfg)
+	if err == nil {
+		i.Seek(0, 0)
+		err = limits.checkFrames(i, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// only needed for finding near duplicates, so an image that
+	// won't fully decode is still taken, just without one
+	i.Seek(0, 0)
+	phash := ""
+	if decoded, _, err := image.Decode(i); err == nil {
+		phash = formatPerceptualHash(dHash(decoded))
+	}
+	return &ingestedImage{Hash: ahash, Extension: ext, Config: cfg, Length: length, PerceptualHash: phash}, nil
+}
+
+func (img *ingestedImage) original() *ImageSpecifier {
+	return originalSpecifier(img.Hash, "."+img.Extension)
+}
+
+// writes an examined upload into the store as the original for its hash
+func (img *ingestedImage) write(st Store, i io.ReadSeeker) error {
+	i.Seek(0, 0)
+	// the store re-checks the digest as it writes, so if the
+	// upload changed out from under us nothing gets stored
+	return st.Put(img.original(), i)
+}
+
+// examineUpload, then write it out
+func ingestImage(st Store, i io.ReadSeeker, expected, algorithm string, limits ImageLimits) (*ingestedImage, error) {
+	img, err := examineUpload(i, expected, algorithm, limits)
+	if err != nil {
+		return nil, err
+	}
+	err = img.write(st, i)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+var errDeleted = uploadError{410, "image has been deleted"}
+
+// ingestImage, plus the parts that need to know about the rest
+// of the cluster, and writing the metadata sidecar. meta only needs
+// the fields the client told us about; the rest are filled in.
+func (ctx Context) ingest(i io.ReadSeeker, expected string, meta ImageMetadata) (*ingestedImage, error) {
+	if expected != "" && ctx.Cluster.Tombstoned(expected) {
+		return nil, errDeleted
+	}
+	img, err := examineUpload(i, expected, ctx.Cfg.HashAlgorithm, ctx.Cfg.Limits())
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.save(img, i, meta)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// the second half of ingest, once we know what the upload is
+func (ctx Context) save(img *ingestedImage, i io.ReadSeeker, meta ImageMetadata) error {
+	if ctx.Cluster.Tombstoned(img.Hash.String()) {
+		return errDeleted
+	}
+	err := img.write(ctx.Store, i)
+	if err != nil {
+		return err
+	}
+
+	if existing, err := ctx.Store.GetMetadata(img.Hash); err == nil && existing.Hash == img.Hash.String() {
+		// first upload wins. later ones (and replicas being
+		// stashed back to us) don't get to rewrite history
+		img.Metadata = *existing
+		return nil
+	}
+	meta.Hash = img.Hash.String()
+	meta.Extension = img.Extension
+	meta.Width = img.Config.Width
+	meta.Height = img.Config.Height
+	meta.Length = img.Length
+	if img.PerceptualHash != "" {
+		meta.PerceptualHash = img.PerceptualHash
+	}
+	if meta.Uploaded.IsZero() {
+		meta.Uploaded = time.Now()
+	}
+	err = ctx.Store.PutMetadata(img.Hash, meta)
+	if err != nil {
+		// not fatal. the verifier will regenerate it
+		ctx.SL.Err(fmt.Sprintf("could not write metadata for %s: %s", img.Hash.String(), err.Error()))
+	}
+	img.Metadata = meta
+	return nil
+}
+
+// everything a client upload goes through: ingest it and replicate
+// it out. If the nodes it would be written to already have it, none
+// of that needs doing and we just say where it already is.
+//
+// near_duplicates says what to do if it looks like something already
+// in the cluster: "reject" it, "flag" it in the response, or (if
+// empty) don't bother looking. key is only for asking other nodes.
+func (ctx Context) upload(i io.ReadSeeker, meta ImageMetadata, size_hints, near_duplicates, key string) (ImageData, error) {
+	if !validNearDuplicatesPolicy(near_duplicates) {
+		return ImageData{}, uploadError{400, "near_duplicates must be reject or flag"}
+	}
+	img, err := examineUpload(i, "", ctx.Cfg.HashAlgorithm, ctx.Cfg.Limits())
+	if err != nil {
+		return ImageData{}, err
+	}
+	if ctx.Cluster.Tombstoned(img.Hash.String()) {
+		return ImageData{}, errDeleted
+	}
+	similar, err := ctx.nearDuplicates(img, near_duplicates, key)
+	if err != nil {
+		return ImageData{}, err
+	}
+	if nodes, ok := ctx.existingReplicas(img); ok {
+		id := img.imageData(nodes, ctx.Cfg.MinReplication)
+		id.Existing = true
+		id.Similar = similar
+		return id, nil
+	}
+	err = ctx.save(img, i, meta)
+	if err != nil {
+		return ImageData{}, err
+	}
+	id := ctx.replicate(img, size_hints)
+	id.Similar = similar
+	return id, nil
+}
+
+// checks the nodes an image would be stashed to for copies they
+// already have. ok if every one of them does, in which case the
+// nicknames are where it lives.
+func (ctx Context) existingReplicas(img *ingestedImage) ([]string, bool) {
+	// retrieve_info wants the extension without the dot
+	ri := &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("full"), Extension: img.Extension}
+	nodes := make([]string, 0)
+	for _, n := range ctx.Cluster.WriteOrder(img.Hash.String()) {
+		if len(nodes) >= ctx.Cfg.Replication {
+			break
+		}
+		if n.UUID == "" {
+			// fewer writeable nodes than neighbors
+			break
+		}
+		if n.UUID == ctx.Cluster.Myself.UUID {
+			_, err := ctx.Store.Stat(img.original())
+			if err != nil {
+				return nil, false
+			}
+		} else {
+			info, err := n.RetrieveImageInfo(ri)
+			if err != nil || !info.Local {
+				return nil, false
+			}
+		}
+		nodes = append(nodes, n.Nickname)
+	}
+	return nodes, len(nodes) > 0
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testImage(w, h int) image.Image {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			m.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return m
+}
+
+func encodedTestImage(ext string, w, h int) []byte {
+	var buf bytes.Buffer
+	switch ext {
+	case "jpg":
+		jpeg.Encode(&buf, testImage(w, h), nil)
+	case "png":
+		png.Encode(&buf, testImage(w, h))
+	case "gif":
+		gif.Encode(&buf, testImage(w, h), nil)
+	}
+	return buf.Bytes()
+}
+
+func Test_detectImageFormat(t *testing.T) {
+	for _, ext := range []string{"jpg", "png", "gif"} {
+		detected, cfg, err := detectImageFormat(bytes.NewReader(encodedTestImage(ext, 30, 20)))
+		if err != nil {
+			t.Errorf("couldn't detect %s: %s", ext, err)
+		}
+		if detected != ext {
+			t.Errorf("detected %s as %s", ext, detected)
+		}
+		if cfg.Width != 30 || cfg.Height != 20 {
+			t.Errorf("wrong dimensions for %s", ext)
+		}
+	}
+
+	_, _, err := detectImageFormat(strings.NewReader("this is not an image"))
+	if err == nil {
+		t.Error("garbage should not be detected as an image")
+	}
+	ue, ok := err.(uploadError)
+	if !ok || ue.Status != 415 {
+		t.Error("should be a 415")
+	}
+}
+
+func Test_ingestImage(t *testing.T) {
+	st := NewMemoryStore()
+
+	img, err := ingestImage(st, bytes.NewReader(encodedTestImage("png", 10, 10)), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatalf("couldn't ingest: %s", err)
+	}
+	if img.Extension != "png" {
+		t.Error("should have been stored as png")
+	}
+	if img.original().String() != img.Hash.String()+"/full/image.png" {
+		t.Errorf("wrong specifier: %s", img.original().String())
+	}
+	if _, err := st.Stat(img.original()); err != nil {
+		t.Error("original wasn't written")
+	}
+
+	_, err = ingestImage(st, bytes.NewReader(encodedTestImage("png", 10, 10)),
+		"fb682e05b9be61797601e60165825c0b089f755e", "", ImageLimits{})
+	if err == nil {
+		t.Error("expected hash didn't match, should have failed")
+	}
+
+	_, err = ingestImage(st, strings.NewReader("not an image"), "", "", ImageLimits{})
+	if err == nil {
+		t.Error("should not ingest garbage")
+	}
+}
+
+func Test_examineUploadAlgorithms(t *testing.T) {
+	contents := encodedTestImage("png", 10, 10)
+	img, err := examineUpload(bytes.NewReader(contents), "", "", ImageLimits{})
+	if err != nil || img.Hash.Algorithm != "sha256" || !img.Hash.Matches(contents) {
+		t.Error("new uploads should be sha256 by default")
+	}
+	old, err := examineUpload(bytes.NewReader(contents), "", "sha1", ImageLimits{})
+	if err != nil || old.Hash.Algorithm != "sha1" || !old.Hash.Matches(contents) {
+		t.Error("should still be able to hash with sha1")
+	}
+	// a replica being stashed is checked against whatever
+	// it was originally addressed by
+	stashed, err := examineUpload(bytes.NewReader(contents), old.Hash.String(), "sha256", ImageLimits{})
+	if err != nil || stashed.Hash.String() != old.Hash.String() {
+		t.Error("expected sha1 hash should be checked with sha1")
+	}
+	st := NewMemoryStore()
+	if err := old.write(st, bytes.NewReader(contents)); err != nil {
+		t.Errorf("store should check sha1 originals with sha1: %s", err)
+	}
+	if err := img.write(st, bytes.NewReader(contents)); err != nil {
+		t.Errorf("store should check sha256 originals with sha256: %s", err)
+	}
+	if _, err := examineUpload(bytes.NewReader(contents), "nonsense", "", ImageLimits{}); err == nil {
+		t.Error("garbage expected hash should be refused")
+	}
+}
+
+func Test_ImageLimits(t *testing.T) {
+	st := NewMemoryStore()
+	contents := encodedTestImage("png", 40, 30)
+
+	limits := []ImageLimits{
+		{MaxBytes: 10},
+		{MaxWidth: 39},
+		{MaxHeight: 29},
+		{MaxPixels: 40*30 - 1},
+	}
+	for _, l := range limits {
+		_, err := ingestImage(st, bytes.NewReader(contents), "", "", l)
+		ue, ok := err.(uploadError)
+		if !ok || ue.Status != 413 {
+			t.Errorf("%+v should have been a 413", l)
+		}
+	}
+	_, err := ingestImage(st, bytes.NewReader(contents), "", "",
+		ImageLimits{MaxBytes: int64(len(contents)), MaxWidth: 40, MaxHeight: 30, MaxPixels: 40 * 30})
+	if err != nil {
+		t.Errorf("right at the limits should be fine: %s", err)
+	}
+}
+
+func Test_uploadExisting(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	contents := encodedTestImage("png", 12, 12)
+
+	id, err := ctx.upload(bytes.NewReader(contents), ImageMetadata{}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Existing {
+		t.Error("first upload can't be existing")
+	}
+	id, err = ctx.upload(bytes.NewReader(contents), ImageMetadata{}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Existing || !id.Satisfied {
+		t.Error("we're the only node and already have it")
+	}
+	if len(id.Nodes) != 1 || id.Nodes[0] != "myself" {
+		t.Errorf("wrong nodes: %v", id.Nodes)
+	}
+
+	// now a neighbor that the hash will also be written to
+	local := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stash/" {
+			w.Write([]byte("ok"))
+		} else if local {
+			w.Write([]byte(`{"hash": "x", "extension": "png", "local": true}`))
+		} else {
+			http.Error(w, "not found", 404)
+		}
+	}))
+	defer ts.Close()
+	ctx.Cluster.AddNeighbor(NodeData{Nickname: "neighbor", UUID: "neighbor-uuid", BaseUrl: ts.URL, Writeable: true})
+	ctx.Cfg.Replication = 2
+
+	id, err = ctx.upload(bytes.NewReader(contents), ImageMetadata{}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Existing {
+		t.Error("the neighbor doesn't have it yet")
+	}
+	local = true
+	id, err = ctx.upload(bytes.NewReader(contents), ImageMetadata{}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Existing || len(id.Nodes) != 2 {
+		t.Errorf("both nodes have it, got %+v", id)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// one original, as seen by a node's listing
+type ListedImage struct {
+	Hash        string   `json:"hash"`
+	Extension   string   `json:"extension"`
+	Length      int64    `json:"length"`
+	Derivatives []string `json:"derivatives"`
+	Nodes       []string `json:"nodes,omitempty"`
+}
+
+// a page of images, in hash order. pass Next back
+// in as "after" to get the following page.
+type ImageListing struct {
+	Images      []ListedImage `json:"images"`
+	Next        string        `json:"next,omitempty"`
+	Unreachable []string      `json:"unreachable,omitempty"`
+}
+
+var errListingFull = errors.New("listing page is full")
+
+// walks the store the same way the verifier does,
+// collecting up to limit originals whose hash sorts
+// after the given one.
+func listLocalImages(st Store, after string, limit int, c *Cluster) (*ImageListing, error) {
+	listing := &ImageListing{Images: make([]ListedImage, 0)}
+	err := st.List(after, func(ri *ImageSpecifier) error {
+		if c != nil && c.Tombstoned(ri.Hash.String()) {
+			return nil
+		}
+		if len(listing.Images) >= limit {
+			// there's at least one more, so it's worth
+			// telling them to come back for another page
+			listing.Next = listing.Images[len(listing.Images)-1].Hash
+			return errListingFull
+		}
+		listing.Images = append(listing.Images, listedImage(st, ri))
+		return nil
+	})
+	if err != nil && err != errListingFull {
+		return nil, err
+	}
+	return listing, nil
+}
+
+func listedImage(st Store, ri *ImageSpecifier) ListedImage {
+	length, _ := st.Stat(ri)
+	li := ListedImage{
+		Hash:        ri.Hash.String(),
+		Extension:   strings.TrimPrefix(ri.Extension, "."),
+		Length:      length,
+		Derivatives: make([]string, 0),
+	}
+	entries, _ := st.Entries(ri.Hash)
+	for _, e := range entries {
+		if e.Size.IsFull() {
+			continue
+		}
+		li.Derivatives = append(li.Derivatives, e.filename())
+	}
+	sort.Strings(li.Derivatives)
+	return li
+}
+
+// combines listings from several nodes into one page.
+// nodes[i] is the nickname of the node listings[i] came from.
+func mergeListings(listings []*ImageListing, nodes []string, limit int) *ImageListing {
+	byHash := make(map[string]*ListedImage)
+	var more = false
+	for i, l := range listings {
+		if l == nil {
+			continue
+		}
+		more = more || l.Next != ""
+		for _, img := range l.Images {
+			existing, ok := byHash[img.Hash]
+			if !ok {
+				img := img
+				img.Nodes = nil
+				existing = &img
+				byHash[img.Hash] = existing
+			}
+			existing.Nodes = append(existing.Nodes, nodes[i])
+		}
+	}
+	merged := &ImageListing{Images: make([]ListedImage, 0, len(byHash))}
+	for _, img := range byHash {
+		merged.Images = append(merged.Images, *img)
+	}
+	sort.Sort(listedImagesByHash(merged.Images))
+	if len(merged.Images) > limit {
+		merged.Images = merged.Images[:limit]
+		more = true
+	}
+	if more && len(merged.Images) > 0 {
+		merged.Next = merged.Images[len(merged.Images)-1].Hash
+	}
+	return merged
+}
+
+type listedImagesByHash []ListedImage
+
+func (p listedImagesByHash) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p listedImagesByHash) Len() int           { return len(p) }
+func (p listedImagesByHash) Less(i, j int) bool { return p[i].Hash < p[j].Hash }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/thraxil/resize"
+)
+
+func Test_listLocalImages(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	var hashes []string
+	for i := 1; i <= 5; i++ {
+		img, err := ctx.ingest(bytes.NewReader(encodedTestImage("png", i, i)), "", ImageMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, img.Hash.String())
+		if i == 1 {
+			// give one of them a derivative
+			d := &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("100s"), Extension: ".png"}
+			ctx.Store.Put(d, bytes.NewReader(encodedTestImage("png", 1, 1)))
+		}
+	}
+	sort.Strings(hashes)
+
+	l, err := listLocalImages(ctx.Store, "", 100, ctx.Cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Images) != 5 || l.Next != "" {
+		t.Fatalf("expected all 5 images and no next page, got %d, %q", len(l.Images), l.Next)
+	}
+	for i, img := range l.Images {
+		if img.Hash != hashes[i] {
+			t.Error("listing should be in hash order")
+		}
+		if img.Extension != "png" || img.Length == 0 {
+			t.Error("wrong extension or length")
+		}
+	}
+
+	// page through two at a time
+	var seen []string
+	after := ""
+	for pages := 0; pages < 10; pages++ {
+		l, err = listLocalImages(ctx.Store, after, 2, ctx.Cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, img := range l.Images {
+			seen = append(seen, img.Hash)
+		}
+		if l.Next == "" {
+			break
+		}
+		after = l.Next
+	}
+	if len(seen) != 5 {
+		t.Errorf("paging should have found all 5, got %d", len(seen))
+	}
+	for i := range seen {
+		if seen[i] != hashes[i] {
+			t.Error("pages out of order or duplicated")
+		}
+	}
+}
+
+func Test_mergeListings(t *testing.T) {
+	a := &ImageListing{Images: []ListedImage{{Hash: "aa"}, {Hash: "cc"}}}
+	b := &ImageListing{Images: []ListedImage{{Hash: "bb"}, {Hash: "cc"}}, Next: "cc"}
+	m := mergeListings([]*ImageListing{a, b}, []string{"node-a", "node-b"}, 10)
+	if len(m.Images) != 3 {
+		t.Fatalf("expected 3 distinct images, got %d", len(m.Images))
+	}
+	if m.Images[0].Hash != "aa" || m.Images[1].Hash != "bb" || m.Images[2].Hash != "cc" {
+		t.Error("merged listing out of order")
+	}
+	if len(m.Images[2].Nodes) != 2 {
+		t.Error("cc is on both nodes")
+	}
+	if m.Next != "cc" {
+		t.Error("one of the nodes had more, so there should be a next page")
+	}
+
+	m = mergeListings([]*ImageListing{a, b}, []string{"node-a", "node-b"}, 2)
+	if len(m.Images) != 2 || m.Next != "bb" {
+		t.Error("should have been cut off at the limit")
+	}
+}
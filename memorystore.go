@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keeps everything in maps. Mostly useful for tests, or a node
+// that only ever serves out of a cache.
+type MemoryStore struct {
+	mu       sync.Mutex
+	images   map[string][]byte
+	specs    map[string]*ImageSpecifier
+	metadata map[string]ImageMetadata
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		images:   make(map[string][]byte),
+		specs:    make(map[string]*ImageSpecifier),
+		metadata: make(map[string]ImageMetadata),
+	}
+}
+
+func (m *MemoryStore) Put(ri *ImageSpecifier, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if ri.Size.IsFull() {
+		err = checkDigest(b, ri.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.images[ri.String()] = b
+	m.specs[ri.String()] = ri
+	return nil
+}
+
+func (m *MemoryStore) Get(ri *ImageSpecifier) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.images[ri.String()]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *MemoryStore) Stat(ri *ImageSpecifier) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.images[ri.String()]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(b)), nil
+}
+
+func (m *MemoryStore) Entries(hash *Hash) ([]*ImageSpecifier, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []*ImageSpecifier
+	for k, ri := range m.specs {
+		if strings.HasPrefix(k, hash.String()+"/") {
+			entries = append(entries, ri)
+		}
+	}
+	if entries == nil {
+		return nil, os.ErrNotExist
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) List(after string, fn func(ri *ImageSpecifier) error) error {
+	// copied out so fn is free to use the store
+	m.mu.Lock()
+	var originals []*ImageSpecifier
+	for _, ri := range m.specs {
+		if ri.Size.IsFull() && ri.Hash.String() > after {
+			originals = append(originals, ri)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(originals, func(i, j int) bool {
+		return originals[i].Hash.String() < originals[j].Hash.String()
+	})
+	for _, ri := range originals {
+		err := fn(ri)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(ri *ImageSpecifier) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.images[ri.String()]; !ok {
+		return os.ErrNotExist
+	}
+	delete(m.images, ri.String())
+	delete(m.specs, ri.String())
+	return nil
+}
+
+func (m *MemoryStore) DeleteAll(hash *Hash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.specs {
+		if strings.HasPrefix(k, hash.String()+"/") {
+			delete(m.images, k)
+			delete(m.specs, k)
+		}
+	}
+	delete(m.metadata, hash.String())
+	return nil
+}
+
+func (m *MemoryStore) GetMetadata(hash *Hash) (*ImageMetadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	md, ok := m.metadata[hash.String()]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &md, nil
+}
+
+func (m *MemoryStore) PutMetadata(hash *Hash, md ImageMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metadata[hash.String()] = md
+	return nil
+}
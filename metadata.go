@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// in a DiskStore, lives next to full.<ext> in each image's directory
+const metadataFilename = "meta.json"
+
+// everything we know about an original besides its bytes
+type ImageMetadata struct {
+	Hash      string    `json:"hash"`
+	Extension string    `json:"extension"`
+	Filename  string    `json:"filename"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Length    int64     `json:"length"`
+	Uploaded  time.Time `json:"uploaded"`
+	UploadKey string    `json:"upload_key"`
+	// dHash of the original, for finding near duplicates
+	PerceptualHash string `json:"phash,omitempty"`
+}
+
+// what the client told us about an upload. Everything
+// else gets filled in from the image itself.
+func uploadMetadata(filename, key string) ImageMetadata {
+	return ImageMetadata{
+		Filename:  filepath.Base(filename),
+		UploadKey: keyFingerprint(key),
+		Uploaded:  time.Now(),
+	}
+}
+
+// enough to tell which key was used without
+// handing the key itself out through /info/
+func keyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	h := sha1.New()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%x", h.Sum(nil))[:8]
+}
+
+func parseMetadata(b []byte) (*ImageMetadata, error) {
+	var m ImageMetadata
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Hash == "" {
+		return nil, errors.New("metadata is missing a hash")
+	}
+	return &m, nil
+}
+
+// the best we can do with just the original. we lose the
+// filename and key, and the store doesn't keep track of when
+// things were written, so the upload time becomes now.
+func metadataFromStore(st Store, ri *ImageSpecifier) (*ImageMetadata, error) {
+	r, err := st.Get(ri)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	length, err := st.Stat(ri)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageMetadata{
+		Hash:           ri.Hash.String(),
+		Extension:      strings.TrimPrefix(ri.Extension, "."),
+		Width:          img.Bounds().Dx(),
+		Height:         img.Bounds().Dy(),
+		Length:         length,
+		Uploaded:       time.Now(),
+		PerceptualHash: formatPerceptualHash(dHash(img)),
+	}, nil
+}
+
+// for metadata written before we kept track of it
+func perceptualHashFromStore(st Store, ri *ImageSpecifier) (string, error) {
+	r, err := st.Get(ri)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+	return formatPerceptualHash(dHash(img)), nil
+}
+
+// make sure the original has sane metadata. Other nodes'
+// copies are preferred since they may know the filename and key.
+func repair_metadata(st Store, ri *ImageSpecifier, c *Cluster, sl Logger) error {
+	hash := ri.Hash
+	m, err := st.GetMetadata(hash)
+	if err == nil && m.Hash == hash.String() {
+		if m.PerceptualHash != "" {
+			return nil
+		}
+		phash, err := perceptualHashFromStore(st, ri)
+		if err != nil {
+			// can't be decoded; nothing more we can add
+			return nil
+		}
+		m.PerceptualHash = phash
+		return st.PutMetadata(hash, *m)
+	}
+	sl.Warning(fmt.Sprintf("metadata for %s is missing or broken", hash.String()))
+	for _, n := range c.ReadOrder(hash.String()) {
+		if n.UUID == c.Myself.UUID {
+			continue
+		}
+		m, err = n.RetrieveMetadata(hash)
+		if err == nil && m.Hash == hash.String() {
+			sl.Info(fmt.Sprintf("got metadata for %s from %s", hash.String(), n.Nickname))
+			return st.PutMetadata(hash, *m)
+		}
+	}
+	m, err = metadataFromStore(st, ri)
+	if err != nil {
+		return err
+	}
+	sl.Info(fmt.Sprintf("regenerated metadata for %s", hash.String()))
+	return st.PutMetadata(hash, *m)
+}
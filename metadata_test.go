@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_keyFingerprint(t *testing.T) {
+	if keyFingerprint("") != "" {
+		t.Error("no key, no fingerprint")
+	}
+	f := keyFingerprint("sekrit")
+	if len(f) != 8 || f == "sekrit" {
+		t.Errorf("bad fingerprint: %s", f)
+	}
+	if keyFingerprint("sekrit") != f {
+		t.Error("fingerprint should be stable")
+	}
+}
+
+func Test_ingestWritesMetadata(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	contents := encodedTestImage("gif", 12, 7)
+	img, err := ctx.ingest(bytes.NewReader(contents), "", uploadMetadata("/some/where/cat.gif", "sekrit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ctx.Store.GetMetadata(img.Hash)
+	if err != nil {
+		t.Fatalf("no metadata written: %s", err)
+	}
+	if m.Hash != img.Hash.String() || m.Extension != "gif" {
+		t.Error("wrong hash or extension")
+	}
+	if m.Filename != "cat.gif" {
+		t.Errorf("wrong filename: %s", m.Filename)
+	}
+	if m.Width != 12 || m.Height != 7 || m.Length != int64(len(contents)) {
+		t.Error("wrong dimensions or length")
+	}
+	if m.UploadKey != keyFingerprint("sekrit") {
+		t.Error("wrong key fingerprint")
+	}
+
+	// a second upload of the same image keeps the original record
+	_, err = ctx.ingest(bytes.NewReader(contents), "", uploadMetadata("dog.gif", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ = ctx.Store.GetMetadata(img.Hash)
+	if m.Filename != "cat.gif" {
+		t.Error("first upload's metadata should win")
+	}
+}
+
+func Test_metadataFromStore(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	img, err := ingestImage(ctx.Store, bytes.NewReader(encodedTestImage("png", 3, 4)), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := metadataFromStore(ctx.Store, img.original())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Width != 3 || m.Height != 4 || m.Extension != "png" || m.Hash != img.Hash.String() {
+		t.Error("couldn't rebuild metadata from the original")
+	}
+
+	err = repair_metadata(ctx.Store, img.original(), ctx.Cluster, DummyLogger{})
+	if err != nil {
+		t.Errorf("repair failed: %s", err)
+	}
+	if _, err := ctx.Store.GetMetadata(img.Hash); err != nil {
+		t.Error("repair didn't write a sidecar")
+	}
+}
+
+func Test_InfoHandler(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	img, err := ctx.ingest(bytes.NewReader(encodedTestImage("png", 5, 6)), "", uploadMetadata("x.png", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/info/"+img.Hash.String()+"/", nil)
+	w := httptest.NewRecorder()
+	InfoHandler(w, r, ctx)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var m ImageMetadata
+	json.Unmarshal(w.Body.Bytes(), &m)
+	if m.Width != 5 || m.Height != 6 {
+		t.Error("wrong dimensions from /info/")
+	}
+
+	r = httptest.NewRequest("GET", "/info/fb682e05b9be61797601e60165825c0b089f755e/?local=true", nil)
+	w = httptest.NewRecorder()
+	InfoHandler(w, r, ctx)
+	if w.Code != 404 {
+		t.Error("unknown image should 404")
+	}
+}
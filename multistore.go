@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNoDirectories = errors.New("no healthy upload directories")
+
+// spreads images across several upload directories (usually one
+// per disk), each laid out like a DiskStore. Every hash gets its
+// own preference order over the directories by rendezvous hashing,
+// so adding or losing a directory only moves the images that were
+// on it.
+//
+// A directory that fails its health check is taken out of rotation
+// until it passes again. Nothing here copies its images anywhere;
+// the verifiers on the other nodes notice that we've lost them and
+// stash them back to us, which lands them on a healthy directory.
+type MultiStore struct {
+	sl   Logger
+	mu   sync.RWMutex
+	dirs []*storeDirectory
+}
+
+type storeDirectory struct {
+	store *DiskStore
+	DirectoryStatus
+}
+
+// for the status page
+type DirectoryStatus struct {
+	Path        string
+	Healthy     bool
+	LastError   string
+	LastChecked time.Time
+}
+
+// directories start out assumed healthy. Call CheckHealth
+// to find out for sure.
+func NewMultiStore(dirs []string, sl Logger) *MultiStore {
+	m := &MultiStore{sl: sl}
+	for _, dir := range dirs {
+		m.dirs = append(m.dirs, &storeDirectory{
+			store:           NewDiskStore(dir),
+			DirectoryStatus: DirectoryStatus{Path: dir, Healthy: true},
+		})
+	}
+	return m
+}
+
+func rendezvousScore(dir string, hash *Hash) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(dir+hash.String())))
+}
+
+// healthy directories, most preferred for this hash first
+func (m *MultiStore) order(hash *Hash) []*storeDirectory {
+	dirs := m.healthy()
+	scores := make(map[*storeDirectory]string, len(dirs))
+	for _, d := range dirs {
+		scores[d] = rendezvousScore(d.Path, hash)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return scores[dirs[i]] > scores[dirs[j]] })
+	return dirs
+}
+
+func (m *MultiStore) healthy() []*storeDirectory {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var dirs []*storeDirectory
+	for _, d := range m.dirs {
+		if d.Healthy {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// where an image's files are, or should go. Usually its first
+// choice, but if it was written somewhere else while that one
+// was down, it stays there so all its files are together.
+func (m *MultiStore) locate(hash *Hash) (*storeDirectory, error) {
+	dirs := m.order(hash)
+	if len(dirs) == 0 {
+		return nil, errNoDirectories
+	}
+	for _, d := range dirs {
+		if _, err := os.Stat(d.store.dir(hash)); err == nil {
+			return d, nil
+		}
+	}
+	return dirs[0], nil
+}
+
+func (m *MultiStore) Put(ri *ImageSpecifier, r io.Reader) error {
+	d, err := m.locate(ri.Hash)
+	if err != nil {
+		return err
+	}
+	err = d.store.Put(ri, r)
+	if err != nil {
+		// might just be a bad upload, but might be the disk
+		m.probe(d)
+	}
+	return err
+}
+
+func (m *MultiStore) Get(ri *ImageSpecifier) (io.ReadCloser, error) {
+	d, err := m.locate(ri.Hash)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.store.Get(ri)
+	if err != nil && !os.IsNotExist(err) {
+		// not just missing, so the disk might be going
+		m.probe(d)
+	}
+	return f, err
+}
+
+func (m *MultiStore) Stat(ri *ImageSpecifier) (int64, error) {
+	d, err := m.locate(ri.Hash)
+	if err != nil {
+		return 0, err
+	}
+	size, err := d.store.Stat(ri)
+	if err != nil && !os.IsNotExist(err) {
+		m.probe(d)
+	}
+	return size, err
+}
+
+func (m *MultiStore) Entries(hash *Hash) ([]*ImageSpecifier, error) {
+	d, err := m.locate(hash)
+	if err != nil {
+		return nil, err
+	}
+	return d.store.Entries(hash)
+}
+
+// the same image can end up in two directories,
+// but mergeWalks only lists it once
+func (m *MultiStore) List(after string, fn func(ri *ImageSpecifier) error) error {
+	var walks []walker
+	for _, d := range m.healthy() {
+		st := d.store
+		walks = append(walks, func(fn func(ri *ImageSpecifier) error) error {
+			return st.List(after, fn)
+		})
+	}
+	return mergeWalks(walks, fn)
+}
+
+func (m *MultiStore) Delete(ri *ImageSpecifier) error {
+	err := error(os.ErrNotExist)
+	for _, d := range m.healthy() {
+		if d.store.Delete(ri) == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (m *MultiStore) DeleteAll(hash *Hash) error {
+	var err error
+	for _, d := range m.healthy() {
+		if e := d.store.DeleteAll(hash); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m *MultiStore) GetMetadata(hash *Hash) (*ImageMetadata, error) {
+	d, err := m.locate(hash)
+	if err != nil {
+		return nil, err
+	}
+	return d.store.GetMetadata(hash)
+}
+
+func (m *MultiStore) PutMetadata(hash *Hash, md ImageMetadata) error {
+	d, err := m.locate(hash)
+	if err != nil {
+		return err
+	}
+	return d.store.PutMetadata(hash, md)
+}
+
+// a directory is healthy if we can write a file to it
+// and get rid of it again
+func (m *MultiStore) probe(d *storeDirectory) {
+	path := d.Path + ".health-check"
+	err := os.MkdirAll(d.Path, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte("ok"), 0644)
+	}
+	if err == nil {
+		err = os.Remove(path)
+	}
+
+	m.mu.Lock()
+	was := d.Healthy
+	d.Healthy = err == nil
+	d.LastChecked = time.Now()
+	d.LastError = ""
+	if err != nil {
+		d.LastError = err.Error()
+	}
+	m.mu.Unlock()
+
+	if was && err != nil {
+		m.sl.Err(fmt.Sprintf("upload directory %s is offline: %s", d.Path, err))
+	} else if !was && err == nil {
+		m.sl.Info(fmt.Sprintf("upload directory %s is back online", d.Path))
+	}
+}
+
+func (m *MultiStore) CheckHealth() {
+	for _, d := range m.dirs {
+		m.probe(d)
+	}
+}
+
+// run this as a goroutine
+func (m *MultiStore) HealthMonitor(sleep int) {
+	for {
+		time.Sleep(time.Duration(sleep) * time.Second)
+		m.CheckHealth()
+	}
+}
+
+func (m *MultiStore) HealthyPaths() []string {
+	var paths []string
+	for _, d := range m.healthy() {
+		paths = append(paths, d.Path)
+	}
+	return paths
+}
+
+func (m *MultiStore) Status() []DirectoryStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	status := make([]DirectoryStatus, len(m.dirs))
+	for i, d := range m.dirs {
+		status[i] = d.DirectoryStatus
+	}
+	return status
+}
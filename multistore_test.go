@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func multiTestDirs(t *testing.T, n int) ([]string, func()) {
+	root, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for i := 0; i < n; i++ {
+		dir, _ := ioutil.TempDir(root, "disk")
+		dirs = append(dirs, dir+"/")
+	}
+	return dirs, func() { os.RemoveAll(root) }
+}
+
+func Test_MultiStore(t *testing.T) {
+	dirs, cleanup := multiTestDirs(t, 3)
+	defer cleanup()
+	storeConformance(t, NewMultiStore(dirs, DummyLogger{}))
+}
+
+func Test_MultiStoreOrder(t *testing.T) {
+	dirs, cleanup := multiTestDirs(t, 3)
+	defer cleanup()
+	m := NewMultiStore(dirs, DummyLogger{})
+	hash, _ := HashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	first := m.order(hash)
+	if len(first) != 3 {
+		t.Fatal("should have all three directories")
+	}
+	// same answer from a store with them listed differently
+	reversed := NewMultiStore([]string{dirs[2], dirs[1], dirs[0]}, DummyLogger{})
+	for i, d := range reversed.order(hash) {
+		if d.Path != first[i].Path {
+			t.Error("directory order shouldn't depend on the config order")
+		}
+	}
+}
+
+func Test_MultiStoreFailover(t *testing.T) {
+	dirs, cleanup := multiTestDirs(t, 2)
+	defer cleanup()
+	m := NewMultiStore(dirs, DummyLogger{})
+	img, err := ingestImage(m, bytes.NewReader(encodedTestImage("png", 4, 4)), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, _ := m.locate(img.Hash)
+	other := m.order(img.Hash)[1]
+
+	// the disk goes away
+	os.RemoveAll(home.Path)
+	ioutil.WriteFile(home.Path[:len(home.Path)-1], []byte("not a directory"), 0644)
+	m.CheckHealth()
+	if len(m.HealthyPaths()) != 1 || m.HealthyPaths()[0] != other.Path {
+		t.Fatal("failed directory should be out of rotation")
+	}
+	if _, err := m.Stat(img.original()); !os.IsNotExist(err) {
+		t.Error("image went with the failed directory")
+	}
+	// and comes back from another node, onto the other directory
+	if err := img.write(m, bytes.NewReader(encodedTestImage("png", 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.store.Stat(img.original()); err != nil {
+		t.Error("should have gone to the remaining directory")
+	}
+
+	// even once the first one is back, the image stays where it is
+	os.Remove(home.Path[:len(home.Path)-1])
+	m.CheckHealth()
+	if len(m.HealthyPaths()) != 2 {
+		t.Error("directory should be back")
+	}
+	if d, _ := m.locate(img.Hash); d != other {
+		t.Error("image should be found where it was rewritten")
+	}
+	var listed int
+	m.List("", func(ri *ImageSpecifier) error {
+		listed++
+		return nil
+	})
+	if listed != 1 {
+		t.Errorf("expected 1 image listed, got %d", listed)
+	}
+	status := m.Status()
+	if len(status) != 2 || status[0].LastChecked.IsZero() {
+		t.Error("status should cover every directory")
+	}
+}
+
+// reads that fail for some reason other than the image not
+// being there check the disk, like writes do
+func Test_MultiStoreReadFailure(t *testing.T) {
+	dirs, cleanup := multiTestDirs(t, 2)
+	defer cleanup()
+	m := NewMultiStore(dirs, DummyLogger{})
+	img, err := ingestImage(m, bytes.NewReader(encodedTestImage("png", 4, 4)), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, _ := m.locate(img.Hash)
+	missing := &ImageSpecifier{Hash: img.Hash, Size: img.original().Size, Extension: ".gif"}
+	if _, err := m.Stat(missing); !os.IsNotExist(err) || len(m.HealthyPaths()) != 2 {
+		t.Error("a missing image is no reason to doubt the disk")
+	}
+
+	fail := func() {
+		// the disk goes away, before a health check notices
+		os.RemoveAll(home.Path)
+		ioutil.WriteFile(home.Path[:len(home.Path)-1], []byte("not a directory"), 0644)
+	}
+	restore := func() {
+		os.Remove(home.Path[:len(home.Path)-1])
+		m.CheckHealth()
+	}
+	fail()
+	if _, err := m.Stat(img.original()); err == nil || os.IsNotExist(err) {
+		t.Fatalf("expected a read error, got %v", err)
+	}
+	if len(m.HealthyPaths()) != 1 {
+		t.Error("a failed Stat should have taken the directory out of rotation")
+	}
+	restore()
+	fail()
+	if _, err := m.Get(img.original()); err == nil || os.IsNotExist(err) {
+		t.Fatalf("expected a read error, got %v", err)
+	}
+	if len(m.HealthyPaths()) != 1 {
+		t.Error("a failed Get should have taken the directory out of rotation")
+	}
+}
+
+func Test_MultiStoreNoDirectories(t *testing.T) {
+	m := NewMultiStore(nil, DummyLogger{})
+	img, _ := examineUpload(bytes.NewReader(encodedTestImage("png", 4, 4)), "", "", ImageLimits{})
+	if err := img.write(m, bytes.NewReader(encodedTestImage("png", 4, 4))); err != errNoDirectories {
+		t.Error("nowhere to put it")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"github.com/thraxil/resize"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// asking for image.auto gets whichever format suits the client
+// best, going by its Accept header. Each one is made, stored and
+// cached under its own extension, like any other.
+const autoExtension = ".auto"
+
+// how much the client wants mime, from 0 to 1. Only an exact
+// match counts: */* doesn't mean a browser can show avif, and
+// the ones that can say so.
+func acceptQuality(accept, mime string) float64 {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != mime {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		return q
+	}
+	return 0
+}
+
+// the first of AutoFormats that the client accepts and some
+// node can make, or else the original's own format. The
+// extension comes back with its leading dot.
+func (ctx Context) negotiateFormat(r *http.Request, hash *Hash, size *resize.SizeSpec) (string, bool) {
+	if !size.IsFull() {
+		accept := r.Header.Get("Accept")
+		for _, format := range ctx.Cfg.AutoFormats {
+			mime, ok := extmimes[format]
+			if ok && acceptQuality(accept, mime) > 0 && ctx.clusterCanMake("."+format) {
+				return "." + format, true
+			}
+		}
+	}
+	return ctx.originalExtension(hash)
+}
+
+func (ctx Context) clusterCanMake(ext string) bool {
+	if ctx.Cluster.GetMyself().CanMake(ext) {
+		return true
+	}
+	for _, n := range ctx.Cluster.GetNeighbors() {
+		if n.Writeable && n.CanMake(ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// what format the original is in, which everything can show
+func (ctx Context) originalExtension(hash *Hash) (string, bool) {
+	if ri, ok := findOriginal(ctx.Store, hash); ok {
+		return ri.Extension, true
+	}
+	if m, ok := ctx.remoteMetadata(hash); ok {
+		return "." + m.Extension, true
+	}
+	return "", false
+}
+
+// the original's metadata from whichever node has it
+func (ctx Context) remoteMetadata(hash *Hash) (*ImageMetadata, bool) {
+	for _, n := range ctx.Cluster.ReadOrder(hash.String()) {
+		if n.UUID == "" || n.UUID == ctx.Cluster.Myself.UUID {
+			continue
+		}
+		m, err := n.RetrieveMetadata(hash)
+		if err == nil && m.Extension != "" {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// a full size in some format other than the original's is made
+// like any other derivative, scaled to fit a box the size of the
+// original's longest side (which leaves it as it is, whichever
+// way up it turns out to be). That way it's stored under that
+// size, and never mistaken for a second original. The first
+// frame of an animated original counts as another format.
+func (ctx Context) fullSizeIn(ri *ImageSpecifier) *ImageSpecifier {
+	if _, err := ctx.Store.Stat(ri); err == nil {
+		return ri
+	}
+	m, err := ctx.Store.GetMetadata(ri.Hash)
+	if err != nil {
+		var ok bool
+		if m, ok = ctx.remoteMetadata(ri.Hash); !ok {
+			return ri
+		}
+	}
+	if ("."+m.Extension == ri.Extension && !ri.Static) || m.Width < 1 || m.Height < 1 {
+		return ri
+	}
+	side := m.Width
+	if m.Height > side {
+		side = m.Height
+	}
+	size := resize.MakeSizeSpec(fmt.Sprintf("%dx%d", side, side))
+	return &ImageSpecifier{Hash: ri.Hash, Size: size, Extension: ri.Extension, Static: ri.Static}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"github.com/thraxil/resize"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_acceptQuality(t *testing.T) {
+	var testCases = []struct {
+		Accept string
+		Mime   string
+		Q      float64
+	}{
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "image/avif", 1},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "image/webp", 1},
+		{"image/webp;q=0.5, */*", "image/webp", 0.5},
+		{"image/avif;q=0", "image/avif", 0},
+		{"image/*,*/*;q=0.8", "image/webp", 0},
+		{"", "image/webp", 0},
+	}
+	for _, tc := range testCases {
+		if q := acceptQuality(tc.Accept, tc.Mime); q != tc.Q {
+			t.Errorf("%s in %q: expected %v, got %v", tc.Mime, tc.Accept, tc.Q, q)
+		}
+	}
+}
+
+func Test_ServeImageHandlerAuto(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	convert, cleanupConvert := fakeConvert(t, `cp "$input" "$last"`)
+	defer cleanupConvert()
+	ctx.Cfg.Writeable = true
+	ctx.Cfg.ImageMagickConvertPath = convert
+	ctx.Cluster.Myself.OutputFormats = []string{"avif", "gif", "jpg", "png", "webp"}
+	ctx.Ch = SharedChannels{ResizeQueue: make(chan ResizeRequest)}
+	go ResizeWorker(ctx.Ch.ResizeQueue, DummyLogger{}, &ctx.Cfg, ctx.Store)
+	defer close(ctx.Ch.ResizeQueue)
+
+	img, err := ctx.ingest(bytes.NewReader(encodedTestImage("png", 30, 20)), "", ImageMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(size, accept string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/image/"+img.Hash.String()+"/"+size+"/image.auto", nil)
+		r.Header.Set("Accept", accept)
+		ServeImageHandler(w, r, ctx)
+		if w.Code != 200 {
+			t.Fatalf("%s for %q failed: %d %s", size, accept, w.Code, w.Body.String())
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Error("should vary on Accept")
+		}
+		return w.Header().Get("Content-Type")
+	}
+	chrome := "image/avif,image/webp,image/apng,image/*,*/*;q=0.8"
+	var testCases = []struct {
+		Size, Accept, Mime string
+	}{
+		{"10w", chrome, "image/avif"},
+		{"10w", "image/avif;q=0,image/webp", "image/webp"},
+		{"10w", "*/*", "image/png"},
+		{"10w", "", "image/png"},
+		// there's only ever the one full size
+		{"full", chrome, "image/png"},
+	}
+	for _, tc := range testCases {
+		if mime := get(tc.Size, tc.Accept); mime != tc.Mime {
+			t.Errorf("%s for %q should have been %s, not %s", tc.Size, tc.Accept, tc.Mime, mime)
+		}
+	}
+	for _, ext := range []string{".avif", ".webp", ".png"} {
+		if _, err := ctx.Store.Stat(&ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("10w"), Extension: ext}); err != nil {
+			t.Errorf("the %s variant should have been stored", ext)
+		}
+	}
+
+	// nobody can make avif any more
+	ctx.Cluster.Myself.OutputFormats = []string{"gif", "jpg", "png", "webp"}
+	if mime := get("20w", chrome); mime != "image/webp" {
+		t.Errorf("should have fallen back to webp, got %s", mime)
+	}
+	ctx.Cfg.AutoFormats = []string{}
+	if mime := get("20w", chrome); mime != "image/png" {
+		t.Errorf("with no auto formats it should be the original's, got %s", mime)
+	}
+
+	w := httptest.NewRecorder()
+	missing := "fb682e05b9be61797601e60165825c0b089f755e"
+	ServeImageHandler(w, httptest.NewRequest("GET", "/image/"+missing+"/10w/image.auto", nil), ctx)
+	if w.Code != 404 {
+		t.Errorf("nothing to negotiate for a missing image, got %d", w.Code)
+	}
+}
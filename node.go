@@ -13,7 +13,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -29,6 +29,10 @@ type NodeData struct {
 	Writeable     bool      `json:"writeable"`
 	LastSeen      time.Time `json:"last_seen"`
 	LastFailed    time.Time `json:"last_failed"`
+	FreeBytes     uint64    `json:"free_bytes"`
+	TotalBytes    uint64    `json:"total_bytes"`
+	// extensions of the formats it can make derivatives in
+	OutputFormats []string `json:"output_formats,omitempty"`
 }
 
 var REPLICAS = 16
@@ -52,6 +56,11 @@ func (n NodeData) IsCurrent() bool {
 	return n.LastSeen.Unix() > n.LastFailed.Unix()
 }
 
+// failed since the last time we heard from it
+func (n NodeData) recentlyFailed() bool {
+	return n.LastFailed.After(n.LastSeen)
+}
+
 // returns version of the BaseUrl that we know
 // starts with 'http://' and does not end with '/'
 func (n NodeData) goodBaseUrl() string {
@@ -79,11 +88,11 @@ func (n NodeData) stashUrl() string {
 
 func (n *NodeData) RetrieveImage(ri *ImageSpecifier) ([]byte, error) {
 	resp, err := http.Get(n.retrieveUrl(ri))
-	defer resp.Body.Close()
 	if err != nil {
 		n.LastFailed = time.Now()
 		return nil, err
 	} // otherwise, we got the image
+	defer resp.Body.Close()
 	n.LastSeen = time.Now()
 	if resp.Status != "200 OK" {
 		return nil, errors.New("404, probably")
@@ -147,15 +156,110 @@ func (n *NodeData) processRetrieveInfoResponse(resp *http.Response) (*ImageInfoR
 	return &response, nil
 }
 
-func postFile(filename string, target_url string, size_hints string) (*http.Response, error) {
+func (n NodeData) infoUrl(hash *Hash) string {
+	return n.goodBaseUrl() + "/info/" + hash.String() + "/?local=true"
+}
+
+// only what the node has locally; it won't go
+// asking the rest of the cluster for us
+func (n *NodeData) RetrieveMetadata(hash *Hash) (*ImageMetadata, error) {
+	resp, err := timedGetRequest(n.infoUrl(hash), 1*time.Second)
+	if err != nil {
+		n.LastFailed = time.Now()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	n.LastSeen = time.Now()
+	if resp.StatusCode != 200 {
+		return nil, errors.New("404, probably")
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadata(b)
+}
+
+func (n NodeData) listUrl(after string, limit int, key string) string {
+	params := url.Values{}
+	params.Set("after", after)
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("key", key)
+	return n.goodBaseUrl() + "/list/?" + params.Encode()
+}
+
+func (n NodeData) similarUrl(hash, phash string, distance int, key string) string {
+	params := url.Values{}
+	params.Set("phash", phash)
+	params.Set("distance", strconv.Itoa(distance))
+	params.Set("key", key)
+	return n.goodBaseUrl() + "/similar/" + hash + "/?" + params.Encode()
+}
+
+// what the node has locally that looks like phash
+func (n *NodeData) SimilarImages(hash, phash string, distance int, key string) (*SimilarImages, error) {
+	resp, err := timedGetRequest(n.similarUrl(hash, phash, distance, key), 10*time.Second)
+	if err != nil {
+		n.LastFailed = time.Now()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	n.LastSeen = time.Now()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("similar returned %s", resp.Status))
+	}
+	var similar SimilarImages
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &similar)
+	if err != nil {
+		return nil, err
+	}
+	return &similar, nil
+}
+
+// one page of what the node has locally
+func (n *NodeData) ListImages(after string, limit int, key string) (*ImageListing, error) {
+	resp, err := timedGetRequest(n.listUrl(after, limit, key), 10*time.Second)
+	if err != nil {
+		n.LastFailed = time.Now()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	n.LastSeen = time.Now()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("listing returned %s", resp.Status))
+	}
+	var listing ImageListing
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &listing)
+	if err != nil {
+		return nil, err
+	}
+	return &listing, nil
+}
+
+func postFile(st Store, ri *ImageSpecifier, target_url string, size_hints string) (*http.Response, error) {
 	body_buf := bytes.NewBufferString("")
 	body_writer := multipart.NewWriter(body_buf)
 	body_writer.WriteField("size_hints", size_hints)
-	file_writer, err := body_writer.CreateFormFile("image", filename)
+	// lets the other end check that it got the whole thing intact
+	body_writer.WriteField("hash", ri.Hash.String())
+	if meta, err := st.GetMetadata(ri.Hash); err == nil {
+		if b, err := json.Marshal(meta); err == nil {
+			body_writer.WriteField("metadata", string(b))
+		}
+	}
+	file_writer, err := body_writer.CreateFormFile("image", ri.filename())
 	if err != nil {
 		panic(err.Error())
 	}
-	fh, err := os.Open(filename)
+	fh, err := st.Get(ri)
 	if err != nil {
 		body_writer.Close()
 		return nil, err
@@ -169,8 +273,8 @@ func postFile(filename string, target_url string, size_hints string) (*http.Resp
 	return http.Post(target_url, content_type, body_buf)
 }
 
-func (n *NodeData) Stash(filename string, size_hints string) bool {
-	resp, err := postFile(filename, n.stashUrl(), size_hints)
+func (n *NodeData) Stash(ri *ImageSpecifier, size_hints string, st Store) bool {
+	resp, err := postFile(st, ri, n.stashUrl(), size_hints)
 	if err != nil {
 		return false
 	}
@@ -182,18 +286,50 @@ func (n *NodeData) Stash(filename string, size_hints string) bool {
 	return string(b) == "ok"
 }
 
+func (n NodeData) purgeUrl(hash *Hash) string {
+	return n.goodBaseUrl() + "/purge/" + hash.String() + "/"
+}
+
+// tells the node to drop its copy of an image and
+// remember that it has been deleted
+func (n *NodeData) Purge(t Tombstone, key string) error {
+	hash, err := HashFromString(t.Hash, "")
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("key", key)
+	params.Set("deleted", t.Deleted.Format(time.RFC3339Nano))
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.PostForm(n.purgeUrl(hash), params)
+	if err != nil {
+		n.LastFailed = time.Now()
+		return err
+	}
+	defer resp.Body.Close()
+	n.LastSeen = time.Now()
+	if resp.StatusCode != 200 {
+		return errors.New(fmt.Sprintf("purge returned %s", resp.Status))
+	}
+	return nil
+}
+
 func (n NodeData) announceUrl() string {
 	return n.goodBaseUrl() + "/announce/"
 }
 
 type AnnounceResponse struct {
-	Nickname      string     `json:"nickname"`
-	UUID          string     `json:"uuid"`
-	Location      string     `json:"location"`
-	Writeable     bool       `json:"writeable"`
-	BaseUrl       string     `json:"base_url"`
-	GroupcacheUrl string     `json:"groupcache_url"`
-	Neighbors     []NodeData `json:"neighbors"`
+	Nickname      string      `json:"nickname"`
+	UUID          string      `json:"uuid"`
+	Location      string      `json:"location"`
+	Writeable     bool        `json:"writeable"`
+	BaseUrl       string      `json:"base_url"`
+	GroupcacheUrl string      `json:"groupcache_url"`
+	FreeBytes     uint64      `json:"free_bytes"`
+	TotalBytes    uint64      `json:"total_bytes"`
+	OutputFormats []string    `json:"output_formats,omitempty"`
+	Neighbors     []NodeData  `json:"neighbors"`
+	Tombstones    []Tombstone `json:"tombstones"`
 }
 
 type pingResponse struct {
@@ -213,6 +349,9 @@ func makeParams(originator NodeData) url.Values {
 	} else {
 		params.Set("writeable", "false")
 	}
+	params.Set("free_bytes", strconv.FormatUint(originator.FreeBytes, 10))
+	params.Set("total_bytes", strconv.FormatUint(originator.TotalBytes, 10))
+	params.Set("output_formats", strings.Join(originator.OutputFormats, ","))
 	return params
 }
 
@@ -73,7 +73,7 @@ func Test_Urls(t *testing.T) {
 		t.Error("bad hash")
 	}
 	s := resize.MakeSizeSpec("full")
-	ri := &ImageSpecifier{hash, s, "jpg"}
+	ri := &ImageSpecifier{Hash: hash, Size: s, Extension: "jpg"}
 
 	testOneUrl(n, ri, t,
 		"http://localhost:8080/retrieve/fb682e05b9be61797601e60165825c0b089f755e/full/jpg/",
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Haystack-style storage. Rather than a file per image, records are
+// appended to a few large pack files, and an in-memory index maps
+// each ImageSpecifier to where its bytes are. Originals (unless
+// packOriginals is set) and metadata stay in the underlying Store.
+//
+// Each record is a fixed size header, then the key (the
+// ImageSpecifier's String()), then the data:
+//
+//	magic  uint32
+//	flags  uint8   (packDeleted for a deletion, which has no data)
+//	keylen uint16
+//	length uint64
+//	crc    uint32  (of the data)
+//
+// The index isn't saved anywhere; it's rebuilt from the record
+// headers when the store is opened. Deleting appends a deletion
+// record, and compaction copies the live records out of packs that
+// are mostly dead before removing them.
+type PackStore struct {
+	base          Store
+	dir           string
+	packOriginals bool
+	maxBytes      int64
+
+	mu        sync.RWMutex
+	packs     map[int]*pack
+	active    int
+	index     map[string]packLocation
+	byHash    map[string]map[string]bool
+	originals map[string]*ImageSpecifier
+	// keys whose latest record is a deletion, and the pack it's in
+	deleted map[string]int
+	// how many overwritten or deleted records there still are for
+	// a key. a deletion only needs keeping while this is non-zero
+	stale map[string]int
+}
+
+const (
+	packMagic   uint32 = 0x5254504b // "RTPK"
+	packDeleted uint8  = 1
+)
+
+type packHeader struct {
+	Magic  uint32
+	Flags  uint8
+	KeyLen uint16
+	Length uint64
+	CRC    uint32
+}
+
+var packHeaderSize = int64(binary.Size(packHeader{}))
+
+type pack struct {
+	id   int
+	f    *os.File
+	size int64
+	// bytes taken up by records that have been
+	// overwritten or deleted since
+	dead int64
+}
+
+type packLocation struct {
+	ri     *ImageSpecifier
+	pack   int
+	offset int64 // of the data, not the record
+	length int64
+	crc    uint32
+}
+
+func (l packLocation) recordSize() int64 {
+	return packHeaderSize + int64(len(l.ri.String())) + l.length
+}
+
+func packFilename(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("pack-%06d.dat", id))
+}
+
+func OpenPackStore(base Store, dir string, packOriginals bool, maxBytes int64) (*PackStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	ps := &PackStore{
+		base:          base,
+		dir:           dir,
+		packOriginals: packOriginals,
+		maxBytes:      maxBytes,
+		packs:         make(map[int]*pack),
+		index:         make(map[string]packLocation),
+		byHash:        make(map[string]map[string]bool),
+		originals:     make(map[string]*ImageSpecifier),
+		deleted:       make(map[string]int),
+		stale:         make(map[string]int),
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "pack-*.dat"))
+	var ids []int
+	for _, m := range matches {
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), "pack-"), ".dat"))
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	// later records win, so order matters
+	sort.Ints(ids)
+	for _, id := range ids {
+		f, err := os.OpenFile(packFilename(dir, id), os.O_RDWR, 0644)
+		if err != nil {
+			ps.Close()
+			return nil, err
+		}
+		p := &pack{id: id, f: f}
+		ps.packs[id] = p
+		ps.active = id
+		err = ps.scan(p)
+		if err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+	if len(ps.packs) == 0 {
+		_, err = ps.newPack()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+func (ps *PackStore) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, p := range ps.packs {
+		p.f.Close()
+	}
+	return nil
+}
+
+func (ps *PackStore) newPack() (*pack, error) {
+	id := ps.active + 1
+	f, err := os.OpenFile(packFilename(ps.dir, id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &pack{id: id, f: f}
+	ps.packs[id] = p
+	ps.active = id
+	return p, nil
+}
+
+// calls fn with the header of every complete record in the pack,
+// and where its data starts. returns where the last one ends
+// and how big the file is.
+func eachRecord(f *os.File, fn func(key string, h packHeader, start int64)) (int64, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	var offset int64
+	for offset < fi.Size() {
+		var h packHeader
+		err := binary.Read(io.NewSectionReader(f, offset, packHeaderSize), binary.LittleEndian, &h)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			break
+		}
+		if err != nil {
+			return offset, fi.Size(), err
+		}
+		if h.Magic != packMagic {
+			return offset, fi.Size(), errors.New(fmt.Sprintf("corrupt pack %s at %d", f.Name(), offset))
+		}
+		key := make([]byte, h.KeyLen)
+		start := offset + packHeaderSize + int64(h.KeyLen)
+		if start+int64(h.Length) > fi.Size() {
+			break
+		}
+		_, err = f.ReadAt(key, offset+packHeaderSize)
+		if err != nil {
+			return offset, fi.Size(), err
+		}
+		fn(string(key), h, start)
+		offset = start + int64(h.Length)
+	}
+	return offset, fi.Size(), nil
+}
+
+// rebuilds the index from a pack's record headers. A record cut
+// off at the end (we crashed partway through an append) is
+// truncated away; anything else that doesn't look right is an error.
+func (ps *PackStore) scan(p *pack) error {
+	end, size, err := eachRecord(p.f, func(key string, h packHeader, start int64) {
+		ps.apply(key, h, p.id, start)
+	})
+	if err != nil {
+		return err
+	}
+	if end < size {
+		err = p.f.Truncate(end)
+		if err != nil {
+			return err
+		}
+	}
+	p.size = end
+	return nil
+}
+
+// updates the index for a record that's just been read or written
+func (ps *PackStore) apply(key string, h packHeader, id int, start int64) {
+	if old, ok := ps.index[key]; ok {
+		ps.packs[old.pack].dead += old.recordSize()
+		ps.stale[key]++
+		ps.unindex(key)
+	}
+	delete(ps.deleted, key)
+	if h.Flags&packDeleted != 0 {
+		// only needed to keep older records from coming back
+		ps.packs[id].dead += packHeaderSize + int64(len(key))
+		ps.deleted[key] = id
+		return
+	}
+	ri := NewImageSpecifier(key)
+	ps.index[key] = packLocation{ri: ri, pack: id, offset: start, length: int64(h.Length), crc: h.CRC}
+	hash := ri.Hash.String()
+	if ps.byHash[hash] == nil {
+		ps.byHash[hash] = make(map[string]bool)
+	}
+	ps.byHash[hash][key] = true
+	if ri.Size.IsFull() {
+		ps.originals[hash] = ri
+	}
+}
+
+func (ps *PackStore) unindex(key string) {
+	loc := ps.index[key]
+	delete(ps.index, key)
+	hash := loc.ri.Hash.String()
+	delete(ps.byHash[hash], key)
+	if len(ps.byHash[hash]) == 0 {
+		delete(ps.byHash, hash)
+	}
+	if loc.ri.Size.IsFull() {
+		delete(ps.originals, hash)
+	}
+}
+
+// only call with the lock held
+func (ps *PackStore) appendRecord(key string, flags uint8, data []byte) error {
+	p := ps.packs[ps.active]
+	h := packHeader{
+		Magic:  packMagic,
+		Flags:  flags,
+		KeyLen: uint16(len(key)),
+		Length: uint64(len(data)),
+		CRC:    crc32.ChecksumIEEE(data),
+	}
+	size := packHeaderSize + int64(len(key)+len(data))
+	if p.size > 0 && p.size+size > ps.maxBytes {
+		var err error
+		p, err = ps.newPack()
+		if err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	buf.WriteString(key)
+	buf.Write(data)
+	_, err := p.f.WriteAt(buf.Bytes(), p.size)
+	if err == nil {
+		err = p.f.Sync()
+	}
+	if err != nil {
+		// don't leave half a record where the next one goes
+		p.f.Truncate(p.size)
+		return err
+	}
+	start := p.size + packHeaderSize + int64(len(key))
+	p.size += size
+	ps.apply(key, h, p.id, start)
+	return nil
+}
+
+func (ps *PackStore) packed(ri *ImageSpecifier) bool {
+	return ps.packOriginals || !ri.Size.IsFull()
+}
+
+func (ps *PackStore) Put(ri *ImageSpecifier, r io.Reader) error {
+	if !ps.packed(ri) {
+		return ps.base.Put(ri, r)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if ri.Size.IsFull() {
+		err = checkDigest(b, ri.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.appendRecord(ri.String(), 0, b)
+}
+
+func (ps *PackStore) read(loc packLocation) ([]byte, error) {
+	b := make([]byte, loc.length)
+	_, err := ps.packs[loc.pack].f.ReadAt(b, loc.offset)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b) != loc.crc {
+		return nil, errors.New(fmt.Sprintf("bad checksum for %s in pack %d", loc.ri.String(), loc.pack))
+	}
+	return b, nil
+}
+
+func (ps *PackStore) Get(ri *ImageSpecifier) (io.ReadCloser, error) {
+	ps.mu.RLock()
+	loc, ok := ps.index[ri.String()]
+	if !ok {
+		ps.mu.RUnlock()
+		return ps.base.Get(ri)
+	}
+	// read it all while the lock is held, so compaction
+	// can't pull the pack out from under us
+	b, err := ps.read(loc)
+	ps.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (ps *PackStore) Stat(ri *ImageSpecifier) (int64, error) {
+	ps.mu.RLock()
+	loc, ok := ps.index[ri.String()]
+	ps.mu.RUnlock()
+	if ok {
+		return loc.length, nil
+	}
+	return ps.base.Stat(ri)
+}
+
+func (ps *PackStore) Entries(hash *Hash) ([]*ImageSpecifier, error) {
+	entries, err := ps.base.Entries(hash)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, ri := range entries {
+		seen[ri.String()] = true
+	}
+	ps.mu.RLock()
+	for key := range ps.byHash[hash.String()] {
+		if !seen[key] {
+			entries = append(entries, ps.index[key].ri)
+		}
+	}
+	ps.mu.RUnlock()
+	if len(entries) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return entries, nil
+}
+
+// merges the originals in the packs in with the ones in the base
+// store (which has them all, unless packOriginals is set, or was at
+// some point)
+func (ps *PackStore) List(after string, fn func(ri *ImageSpecifier) error) error {
+	ps.mu.RLock()
+	var packed []*ImageSpecifier
+	for hash, ri := range ps.originals {
+		if hash > after {
+			packed = append(packed, ri)
+		}
+	}
+	ps.mu.RUnlock()
+	sort.Slice(packed, func(i, j int) bool {
+		return packed[i].Hash.String() < packed[j].Hash.String()
+	})
+	err := ps.base.List(after, func(ri *ImageSpecifier) error {
+		for len(packed) > 0 && packed[0].Hash.String() <= ri.Hash.String() {
+			next := packed[0]
+			packed = packed[1:]
+			if next.Hash.String() == ri.Hash.String() {
+				continue
+			}
+			if err := fn(next); err != nil {
+				return err
+			}
+		}
+		return fn(ri)
+	})
+	if err != nil {
+		return err
+	}
+	for _, ri := range packed {
+		if err := fn(ri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// only call with the lock held
+func (ps *PackStore) remove(key string) (bool, error) {
+	if _, ok := ps.index[key]; !ok {
+		return false, nil
+	}
+	return true, ps.appendRecord(key, packDeleted, nil)
+}
+
+func (ps *PackStore) Delete(ri *ImageSpecifier) error {
+	ps.mu.Lock()
+	packed, err := ps.remove(ri.String())
+	ps.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = ps.base.Delete(ri)
+	if packed && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (ps *PackStore) DeleteAll(hash *Hash) error {
+	ps.mu.Lock()
+	for key := range ps.byHash[hash.String()] {
+		_, err := ps.remove(key)
+		if err != nil {
+			ps.mu.Unlock()
+			return err
+		}
+	}
+	ps.mu.Unlock()
+	return ps.base.DeleteAll(hash)
+}
+
+func (ps *PackStore) GetMetadata(hash *Hash) (*ImageMetadata, error) {
+	return ps.base.GetMetadata(hash)
+}
+
+func (ps *PackStore) PutMetadata(hash *Hash, m ImageMetadata) error {
+	return ps.base.PutMetadata(hash, m)
+}
+
+// rewrites every pack (other than the one being appended to) where
+// at least threshold of it is dead. Returns how many were compacted.
+func (ps *PackStore) Compact(threshold float64) (int, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var ids []int
+	for id := range ps.packs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	compacted := 0
+	for _, id := range ids {
+		p := ps.packs[id]
+		if id == ps.active || p.size == 0 || float64(p.dead)/float64(p.size) < threshold {
+			continue
+		}
+		err := ps.compactPack(p)
+		if err != nil {
+			return compacted, err
+		}
+		compacted++
+	}
+	return compacted, nil
+}
+
+// one fewer stale record for the key
+func (ps *PackStore) forget(key string) {
+	ps.stale[key]--
+	if ps.stale[key] <= 0 {
+		delete(ps.stale, key)
+	}
+}
+
+// only call with the lock held
+func (ps *PackStore) compactPack(p *pack) error {
+	// the stale records in here are about to be gone for good
+	_, _, err := eachRecord(p.f, func(key string, h packHeader, start int64) {
+		loc, ok := ps.index[key]
+		if h.Flags&packDeleted == 0 && !(ok && loc.pack == p.id && loc.offset == start) {
+			ps.forget(key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for key, loc := range ps.index {
+		if loc.pack != p.id {
+			continue
+		}
+		b, err := ps.read(loc)
+		if err != nil {
+			return err
+		}
+		err = ps.appendRecord(key, 0, b)
+		if err != nil {
+			return err
+		}
+		// the copy we just made doesn't leave a stale one
+		// behind, since this whole pack is going
+		ps.forget(key)
+	}
+	for key, id := range ps.deleted {
+		if id != p.id {
+			continue
+		}
+		if ps.stale[key] == 0 {
+			// nothing older left for it to hold back
+			delete(ps.deleted, key)
+			continue
+		}
+		err := ps.appendRecord(key, packDeleted, nil)
+		if err != nil {
+			return err
+		}
+	}
+	p.f.Close()
+	delete(ps.packs, p.id)
+	return os.Remove(p.f.Name())
+}
+
+// run this as a goroutine
+func (ps *PackStore) Compactor(sleep int, threshold float64, sl Logger) {
+	sl.Info("starting pack compactor")
+	for {
+		time.Sleep(time.Duration(sleep) * time.Second)
+		n, err := ps.Compact(threshold)
+		if err != nil {
+			sl.Err(fmt.Sprintf("pack compaction failed: %s", err.Error()))
+		} else if n > 0 {
+			sl.Info(fmt.Sprintf("compacted %d packs", n))
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thraxil/resize"
+)
+
+func packTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir + "/", func() { os.RemoveAll(dir) }
+}
+
+func Test_PackStore(t *testing.T) {
+	for _, packOriginals := range []bool{false, true} {
+		dir, cleanup := packTestDir(t)
+		ps, err := OpenPackStore(NewDiskStore(dir), dir+"packs", packOriginals, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storeConformance(t, ps)
+		ps.Close()
+		cleanup()
+	}
+}
+
+func Test_PackStoreReopen(t *testing.T) {
+	dir, cleanup := packTestDir(t)
+	defer cleanup()
+	base := NewMemoryStore()
+	ps, err := OpenPackStore(base, dir, true, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _ := ingestImage(ps, bytes.NewReader(encodedTestImage("png", 5, 5)), "", "", ImageLimits{})
+	thumb := &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("10s"), Extension: ".png"}
+	gone := &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("20s"), Extension: ".png"}
+	ps.Put(thumb, bytes.NewReader([]byte("first")))
+	ps.Put(thumb, bytes.NewReader([]byte("second")))
+	ps.Put(gone, bytes.NewReader([]byte("deleted")))
+	ps.Delete(gone)
+	if _, err := base.Stat(img.original()); err == nil {
+		t.Error("original should have gone into a pack")
+	}
+	ps.Close()
+
+	// half a record at the end, like we crashed mid-append
+	f, _ := os.OpenFile(packFilename(dir, 1), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0x4b, 0x50, 0x54})
+	f.Close()
+
+	ps, err = OpenPackStore(base, dir, true, 1<<20)
+	if err != nil {
+		t.Fatalf("couldn't reopen: %s", err)
+	}
+	defer ps.Close()
+	if b, err := readAll(ps, thumb); err != nil || string(b) != "second" {
+		t.Error("latest record should win after reopening")
+	}
+	if _, err := ps.Stat(gone); !os.IsNotExist(err) {
+		t.Error("deletion should survive reopening")
+	}
+	if _, err := ps.Stat(img.original()); err != nil {
+		t.Error("lost the original")
+	}
+	// and it can still be appended to after the truncation
+	ps.Put(gone, bytes.NewReader([]byte("back again")))
+	if b, _ := readAll(ps, gone); string(b) != "back again" {
+		t.Error("couldn't append after truncating a partial record")
+	}
+}
+
+func Test_PackStoreCompact(t *testing.T) {
+	dir, cleanup := packTestDir(t)
+	defer cleanup()
+	base := NewMemoryStore()
+	// small enough that every record rolls over to a new pack
+	ps, err := OpenPackStore(base, dir, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := HashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	keep := &ImageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("10s"), Extension: ".png"}
+	drop := &ImageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("20s"), Extension: ".png"}
+	ps.Put(drop, bytes.NewReader(make([]byte, 1000)))
+	ps.Put(keep, bytes.NewReader([]byte("keep")))
+	ps.Delete(drop)
+	// another one, so the deletion isn't in the active pack
+	other := &ImageSpecifier{Hash: hash, Size: resize.MakeSizeSpec("30s"), Extension: ".png"}
+	ps.Put(other, bytes.NewReader([]byte("other")))
+
+	n, err := ps.Compact(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("the pack with the deleted record should have been compacted")
+	}
+	if _, err := os.Stat(packFilename(dir, 1)); !os.IsNotExist(err) {
+		t.Error("compacted pack should be removed")
+	}
+	if _, err := os.Stat(packFilename(dir, 5)); !os.IsNotExist(err) {
+		t.Error("with the deleted record gone, the deletion didn't need carrying forward")
+	}
+	if b, err := readAll(ps, keep); err != nil || string(b) != "keep" {
+		t.Error("compaction lost a live record")
+	}
+	ps.Close()
+
+	ps, err = OpenPackStore(base, dir, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if _, err := ps.Stat(drop); !os.IsNotExist(err) {
+		t.Error("compaction brought a deleted record back")
+	}
+	if b, err := readAll(ps, keep); err != nil || string(b) != "keep" {
+		t.Error("live record didn't survive compaction and reopening")
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "pack-*.dat"))
+	if len(matches) == 0 {
+		t.Error("should still be some packs")
+	}
+}
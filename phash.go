@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+)
+
+// dimensions of the grid a dHash is worked out on. each row
+// gives one bit per neighboring pair, so 8x8 = 64 bits.
+const (
+	dhashWidth  = 9
+	dhashHeight = 8
+	// most pixels we look at along each side of a grid cell.
+	// plenty to average out noise without reading every
+	// pixel of a huge image.
+	dhashSamples = 16
+)
+
+// a difference hash: shrink the image down to a tiny grayscale
+// grid and record, for each cell, whether it's brighter than the
+// one to its right. Re-encoding, resizing and small tweaks leave
+// most of those bits alone, so similar images have hashes that
+// are a small Hamming distance apart.
+func dHash(img image.Image) uint64 {
+	b := img.Bounds()
+	var grid [dhashHeight][dhashWidth]float64
+	for cy := 0; cy < dhashHeight; cy++ {
+		y0, y1 := cellSpan(b.Min.Y, b.Dy(), cy, dhashHeight)
+		for cx := 0; cx < dhashWidth; cx++ {
+			x0, x1 := cellSpan(b.Min.X, b.Dx(), cx, dhashWidth)
+			grid[cy][cx] = averageLuminance(img, x0, x1, y0, y1)
+		}
+	}
+	var hash uint64
+	for y := 0; y < dhashHeight; y++ {
+		for x := 0; x < dhashWidth-1; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// the pixels along one side that fall in cell i of n. always
+// at least one, even for images smaller than the grid.
+func cellSpan(min, length, i, n int) (int, int) {
+	start := min + i*length/n
+	end := min + (i+1)*length/n
+	if end <= start {
+		end = start + 1
+	}
+	if end > min+length {
+		start, end = min+length-1, min+length
+	}
+	return start, end
+}
+
+func averageLuminance(img image.Image, x0, x1, y0, y1 int) float64 {
+	xstep := (x1-x0)/dhashSamples + 1
+	ystep := (y1-y0)/dhashSamples + 1
+	var total float64
+	var count int
+	for y := y0; y < y1; y += ystep {
+		for x := x0; x < x1; x += xstep {
+			r, g, b, _ := img.At(x, y).RGBA()
+			total += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			count++
+		}
+	}
+	return total / float64(count)
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// how they're written in metadata and URLs
+func formatPerceptualHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func parsePerceptualHash(s string) (uint64, error) {
+	if len(s) != 16 {
+		return 0, errors.New(fmt.Sprintf("invalid perceptual hash: %q", s))
+	}
+	return strconv.ParseUint(s, 16, 64)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+// blocks of random brightness, so that different seeds
+// actually look different (unlike testImage's gradient)
+func patternImage(seed int64, w, h int) image.Image {
+	r := rand.New(rand.NewSource(seed))
+	var blocks [10][12]uint8
+	for y := range blocks {
+		for x := range blocks[y] {
+			blocks[y][x] = uint8(r.Intn(256))
+		}
+	}
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := blocks[y*10/h][x*12/w]
+			m.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return m
+}
+
+func Test_dHash(t *testing.T) {
+	original := dHash(patternImage(1, 240, 200))
+	// same picture, smaller and through a lossy encoder
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, patternImage(1, 120, 100), &jpeg.Options{Quality: 50})
+	reencoded, _, err := image.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := hammingDistance(original, dHash(reencoded)); d > 4 {
+		t.Errorf("re-encoded copy is %d bits away", d)
+	}
+	if d := hammingDistance(original, dHash(patternImage(2, 240, 200))); d < 16 {
+		t.Errorf("different image is only %d bits away", d)
+	}
+	// smaller than the grid shouldn't blow up
+	dHash(patternImage(3, 3, 2))
+	dHash(patternImage(3, 1, 1))
+}
+
+func Test_perceptualHashFormat(t *testing.T) {
+	if formatPerceptualHash(0xff) != "00000000000000ff" {
+		t.Error("should be zero padded")
+	}
+	h, err := parsePerceptualHash("00000000000000ff")
+	if err != nil || h != 0xff {
+		t.Error("didn't parse")
+	}
+	if _, err := parsePerceptualHash("ff"); err == nil {
+		t.Error("too short")
+	}
+	if _, err := parsePerceptualHash("zzzzzzzzzzzzzzzz"); err == nil {
+		t.Error("not hex")
+	}
+	if hammingDistance(0xf0, 0x0f) != 8 {
+		t.Error("wrong distance")
+	}
+}
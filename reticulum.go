@@ -8,8 +8,10 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -56,34 +58,90 @@ func main() {
 	}
 
 	siteconfig := f.MyConfig()
+	if !knownHashAlgorithm(siteconfig.HashAlgorithm) {
+		log.Fatal(fmt.Sprintf("unknown HashAlgorithm: %s", siteconfig.HashAlgorithm))
+	}
+	if !knownResizeEngine(siteconfig.ResizeEngine) {
+		log.Fatal(fmt.Sprintf("unknown ResizeEngine: %s", siteconfig.ResizeEngine))
+	}
+	if _, err := parseHexColor(siteconfig.FlattenBackground); err != nil {
+		log.Fatal(err)
+	}
+	for _, cidr := range siteconfig.FetchAllowedNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			log.Fatal(fmt.Sprintf("bad FetchAllowedNetworks entry: %s", err.Error()))
+		}
+	}
 
 	gcp := &GroupCacheProxy{}
 	c := NewCluster(f.MyNode(), gcp, siteconfig.GroupcacheSize)
 	for i := range f.Neighbors {
 		c.AddNeighbor(f.Neighbors[i])
 	}
+	c.TombstoneKeys = siteconfig.UploadKeys
+	err = c.LoadTombstones(siteconfig.UploadDirectory + "tombstones")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	runtime.GOMAXPROCS(siteconfig.GoMaxProcs)
+	sl := STDLogger{}
+
+	dirs := NewMultiStore(siteconfig.UploadDirectories, sl)
+	dirs.CheckHealth()
+	go dirs.HealthMonitor(siteconfig.CapacityCheckSleep)
+
+	var store Store = dirs
+	if siteconfig.StorageMode == "pack" {
+		ps, err := OpenPackStore(store, siteconfig.PackDirectory, siteconfig.PackOriginals, siteconfig.PackMaxBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go ps.Compactor(siteconfig.PackCompactSleep, siteconfig.PackCompactThreshold, sl)
+		store = ps
+	}
+	derivatives := NewEvictingStore(store, siteconfig.DerivativeBudget, sl)
+	go derivatives.Scan()
+	store = derivatives
+	similar := NewSimilarityIndex(store)
+	go similar.Load(sl)
+	store = similar
 
 	// start our resize worker goroutines
 	var channels = SharedChannels{
 		ResizeQueue: make(chan ResizeRequest),
 	}
-	sl := STDLogger{}
 	for i := 0; i < siteconfig.NumResizeWorkers; i++ {
-		go ResizeWorker(channels.ResizeQueue, sl, &siteconfig)
+		go ResizeWorker(channels.ResizeQueue, sl, &siteconfig, store)
 	}
 
+	// find out what imagemagick can do before telling anyone
+	c.Myself.OutputFormats = probeOutputFormats(&siteconfig, sl)
+	sl.Info(fmt.Sprintf("can make %s", strings.Join(c.Myself.OutputFormats, ", ")))
+
+	// keep track of how full we are before telling anyone
+	c.HighWaterMark = siteconfig.HighWaterMark
+	c.CheckCapacity(dirs.HealthyPaths, sl)
+	go c.MonitorCapacity(dirs.HealthyPaths, siteconfig.CapacityCheckSleep, sl)
+
 	// start our gossiper
 	go c.Gossip(int(f.Port), siteconfig.GossiperSleep, sl)
 
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	VERIFY_OFFSET = r.Intn(10000)
-	go Verify(c, siteconfig, sl)
+	go Verify(c, siteconfig, store, sl)
 
-	ctx := Context{Cluster: c, Cfg: siteconfig, Ch: channels, SL: sl}
+	ctx := Context{Cluster: c, Cfg: siteconfig, Ch: channels, SL: sl, Store: store, Directories: dirs, Derivatives: derivatives, Similar: similar}
 	// set up HTTP Handlers
 	http.HandleFunc("/", makeHandler(AddHandler, ctx))
+	http.HandleFunc("/fetch/", makeHandler(FetchHandler, ctx))
+	http.HandleFunc("/batch/", makeHandler(BatchHandler, ctx))
+	http.HandleFunc("/api/images", makeHandler(ImagesAPIHandler, ctx))
+	http.HandleFunc("/api/images/", makeHandler(ImageAPIHandler, ctx))
+	http.HandleFunc("/purge/", makeHandler(PurgeHandler, ctx))
+	http.HandleFunc("/info/", makeHandler(InfoHandler, ctx))
+	http.HandleFunc("/list/", makeHandler(ListHandler, ctx))
+	http.HandleFunc("/similar/", makeHandler(SimilarHandler, ctx))
 	http.HandleFunc("/stash/", makeHandler(StashHandler, ctx))
 	http.HandleFunc("/image/", makeHandler(ServeImageHandler, ctx))
 	http.HandleFunc("/retrieve/", makeHandler(RetrieveHandler, ctx))
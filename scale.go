@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/thraxil/resize"
+	"image"
+	"image/draw"
+)
+
+// what part of a w x h image gets used for s, and how big
+// it comes out. Same rules as convert: a plain width or height
+// keeps the aspect ratio, WxH fits inside the box, and squares
+// take the middle of the image and fill the whole thing.
+func scaledBounds(w, h int, s *resize.SizeSpec) (image.Rectangle, int, int) {
+	crop := image.Rect(0, 0, w, h)
+	width, height := w, h
+	switch {
+	case s.IsFull():
+	case s.IsSquare():
+		side := w
+		if h < side {
+			side = h
+		}
+		x0, y0 := (w-side)/2, (h-side)/2
+		crop = image.Rect(x0, y0, x0+side, y0+side)
+		width, height = s.Width(), s.Width()
+	case s.Width() > 0 && s.Height() > 0:
+		width, height = s.Width(), h*s.Width()/w
+		if height > s.Height() {
+			width, height = w*s.Height()/h, s.Height()
+		}
+	case s.Width() > 0:
+		width, height = s.Width(), h*s.Width()/w
+	case s.Height() > 0:
+		width, height = w*s.Height()/h, s.Height()
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return crop, width, height
+}
+
+// resizes (and crops, for squares) img to fit s. Going down,
+// each pixel is the average of the ones it covers; going up
+// (which hardly ever happens) they're just repeated.
+func scaleImage(img image.Image, s *resize.SizeSpec) image.Image {
+	b := img.Bounds()
+	crop, width, height := scaledBounds(b.Dx(), b.Dy(), s)
+	src := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(src, src.Bounds(), img, crop.Min.Add(b.Min), draw.Src)
+	if crop.Dx() == width && crop.Dy() == height {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := cellSpan(0, crop.Dy(), y, height)
+		for x := 0; x < width; x++ {
+			x0, x1 := cellSpan(0, crop.Dx(), x, width)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					sum[0] += int(p[0])
+					sum[1] += int(p[1])
+					sum[2] += int(p[2])
+					sum[3] += int(p[3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			p := dst.Pix[y*dst.Stride+x*4:]
+			for i := range sum {
+				// rounded, not truncated
+				p[i] = uint8((sum[i] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/thraxil/resize"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func Test_scaledBounds(t *testing.T) {
+	var testCases = []struct {
+		W, H          int
+		Size          string
+		Crop          image.Rectangle
+		Width, Height int
+	}{
+		{400, 300, "full", image.Rect(0, 0, 400, 300), 400, 300},
+		{400, 300, "100w", image.Rect(0, 0, 400, 300), 100, 75},
+		{400, 300, "150h", image.Rect(0, 0, 400, 300), 200, 150},
+		{400, 300, "100x100", image.Rect(0, 0, 400, 300), 100, 75},
+		{300, 400, "100x100", image.Rect(0, 0, 300, 400), 75, 100},
+		{400, 300, "1000x150", image.Rect(0, 0, 400, 300), 200, 150},
+		{400, 300, "100s", image.Rect(50, 0, 350, 300), 100, 100},
+		{300, 400, "100s", image.Rect(0, 50, 300, 350), 100, 100},
+		{400, 300, "800w", image.Rect(0, 0, 400, 300), 800, 600},
+		{1000, 1, "10w", image.Rect(0, 0, 1000, 1), 10, 1},
+	}
+	for _, tc := range testCases {
+		crop, w, h := scaledBounds(tc.W, tc.H, resize.MakeSizeSpec(tc.Size))
+		if crop != tc.Crop || w != tc.Width || h != tc.Height {
+			t.Errorf("%dx%d at %s: got %v %dx%d", tc.W, tc.H, tc.Size, crop, w, h)
+		}
+	}
+}
+
+func Test_scaleImage(t *testing.T) {
+	for _, size := range []string{"10w", "7h", "10x10", "8s", "50w"} {
+		s := resize.MakeSizeSpec(size)
+		_, w, h := scaledBounds(30, 20, s)
+		b := scaleImage(testImage(30, 20), s).Bounds()
+		if b.Dx() != w || b.Dy() != h {
+			t.Errorf("%s came out %dx%d", size, b.Dx(), b.Dy())
+		}
+	}
+
+	// half black, half white averages out to grey
+	m := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	m.Set(0, 0, color.RGBA{0, 0, 0, 255})
+	m.Set(1, 0, color.RGBA{255, 255, 255, 255})
+	r, _, _, _ := scaleImage(m, resize.MakeSizeSpec("1w")).At(0, 0).RGBA()
+	if r>>8 != 128 {
+		t.Errorf("should have averaged, got %d", r>>8)
+	}
+
+	// squares come from the middle
+	m = image.NewRGBA(image.Rect(0, 0, 3, 1))
+	m.Set(1, 0, color.RGBA{255, 0, 0, 255})
+	r, _, _, _ = scaleImage(m, resize.MakeSizeSpec("1s")).At(0, 0).RGBA()
+	if r>>8 != 255 {
+		t.Error("square crop should be centered")
+	}
+
+	// images don't always start at the origin
+	sub := testImage(30, 20).(*image.RGBA).SubImage(image.Rect(10, 5, 30, 20))
+	if scaleImage(sub, resize.MakeSizeSpec("10w")).Bounds() != image.Rect(0, 0, 10, 7) {
+		t.Error("wrong size for an offset image")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long asking the rest of the cluster can take, all
+// together. Anything slower than that counts as unreachable.
+var similarTimeout = 10 * time.Second
+
+// keeps the perceptual hash of every original in the Store
+// underneath it in memory, so near duplicates can be found without
+// reading any metadata. Watching the metadata go in and out is
+// enough to keep it current, whoever is writing it (uploads,
+// stashes, the verifier filling in old images, deletions).
+type SimilarityIndex struct {
+	Store
+	mu     sync.RWMutex
+	hashes map[string]similarityEntry
+}
+
+type similarityEntry struct {
+	phash     uint64
+	extension string
+}
+
+// one image that's close to the one asked about
+type SimilarImage struct {
+	Hash      string   `json:"hash"`
+	Extension string   `json:"extension"`
+	Distance  int      `json:"distance"`
+	Nodes     []string `json:"nodes,omitempty"`
+}
+
+// everything within Distance of PerceptualHash, closest first
+type SimilarImages struct {
+	Hash           string         `json:"hash"`
+	PerceptualHash string         `json:"phash"`
+	Distance       int            `json:"distance"`
+	Images         []SimilarImage `json:"images"`
+	Unreachable    []string       `json:"unreachable,omitempty"`
+}
+
+func NewSimilarityIndex(st Store) *SimilarityIndex {
+	return &SimilarityIndex{Store: st, hashes: make(map[string]similarityEntry)}
+}
+
+func (s *SimilarityIndex) PutMetadata(hash *Hash, m ImageMetadata) error {
+	err := s.Store.PutMetadata(hash, m)
+	if err == nil {
+		s.add(m)
+	}
+	return err
+}
+
+func (s *SimilarityIndex) DeleteAll(hash *Hash) error {
+	s.mu.Lock()
+	delete(s.hashes, hash.String())
+	s.mu.Unlock()
+	return s.Store.DeleteAll(hash)
+}
+
+func (s *SimilarityIndex) add(m ImageMetadata) {
+	phash, err := parsePerceptualHash(m.PerceptualHash)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashes[m.Hash] = similarityEntry{phash, m.Extension}
+}
+
+// the perceptual hash of something we have
+func (s *SimilarityIndex) Lookup(hash string) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.hashes[hash]
+	return e.phash, ok
+}
+
+// everything within distance of phash, leaving out except
+// (usually the image being compared against)
+func (s *SimilarityIndex) Near(phash uint64, distance int, except string) []SimilarImage {
+	s.mu.RLock()
+	var found []SimilarImage
+	for hash, e := range s.hashes {
+		if hash == except {
+			continue
+		}
+		d := hammingDistance(phash, e.phash)
+		if d <= distance {
+			found = append(found, SimilarImage{Hash: hash, Extension: e.extension, Distance: d})
+		}
+	}
+	s.mu.RUnlock()
+	sortSimilar(found)
+	return found
+}
+
+func sortSimilar(images []SimilarImage) {
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Distance != images[j].Distance {
+			return images[i].Distance < images[j].Distance
+		}
+		return images[i].Hash < images[j].Hash
+	})
+}
+
+// indexes everything that was already there at startup
+// run this as a goroutine
+func (s *SimilarityIndex) Load(sl Logger) {
+	sl.Info("loading perceptual hashes")
+	s.Store.List("", func(ri *ImageSpecifier) error {
+		m, err := s.Store.GetMetadata(ri.Hash)
+		if err == nil {
+			s.add(*m)
+		}
+		return nil
+	})
+	sl.Info("finished loading perceptual hashes")
+}
+
+// combines what each node found. nodes[i] is who found results[i].
+func mergeSimilar(results []*SimilarImages, nodes []string) []SimilarImage {
+	byHash := make(map[string]*SimilarImage)
+	for i, r := range results {
+		for _, img := range r.Images {
+			if existing, ok := byHash[img.Hash]; ok {
+				existing.Nodes = append(existing.Nodes, nodes[i])
+				continue
+			}
+			found := img
+			found.Nodes = []string{nodes[i]}
+			byHash[img.Hash] = &found
+		}
+	}
+	merged := make([]SimilarImage, 0, len(byHash))
+	for _, img := range byHash {
+		merged = append(merged, *img)
+	}
+	sortSimilar(merged)
+	return merged
+}
+
+// what to do with an upload that looks like something we have
+const (
+	nearDuplicatesReject = "reject"
+	nearDuplicatesFlag   = "flag"
+)
+
+func validNearDuplicatesPolicy(policy string) bool {
+	return policy == "" || policy == nearDuplicatesReject || policy == nearDuplicatesFlag
+}
+
+// looks for images within distance of phash, on this node and
+// on neighbors. With neighbors nil, it's just this node. key is
+// passed along to the other nodes, which may need it.
+func (ctx Context) similarImages(hash string, phash uint64, distance int, neighbors []NodeData, key string) *SimilarImages {
+	result := &SimilarImages{
+		Hash:           hash,
+		PerceptualHash: formatPerceptualHash(phash),
+		Distance:       distance,
+		Images:         make([]SimilarImage, 0),
+	}
+	local := &SimilarImages{Images: ctx.Similar.Near(phash, distance, hash)}
+	results := []*SimilarImages{local}
+	nodes := []string{ctx.Cluster.Myself.Nickname}
+	remote, answered := ctx.askSimilar(neighbors, hash, result.PerceptualHash, distance, key)
+	for i, n := range neighbors {
+		if !answered[i] {
+			result.Unreachable = append(result.Unreachable, n.Nickname)
+			continue
+		}
+		results = append(results, remote[i])
+		nodes = append(nodes, n.Nickname)
+	}
+	for _, img := range mergeSimilar(results, nodes) {
+		// the index only hears about deletions once they reach us
+		if ctx.Cluster.Tombstoned(img.Hash) {
+			continue
+		}
+		if neighbors == nil {
+			img.Nodes = nil
+		}
+		result.Images = append(result.Images, img)
+	}
+	return result
+}
+
+// asks every one of neighbors at once, and waits until they've
+// all answered or similarTimeout is up, whichever comes first.
+// What each one said goes in the same place in the results, with
+// answered saying which of them did.
+func (ctx Context) askSimilar(neighbors []NodeData, hash, phash string, distance int, key string) ([]*SimilarImages, []bool) {
+	type answer struct {
+		i int
+		r *SimilarImages
+	}
+	// room for everyone, so the ones that are too late
+	// don't block forever trying to answer
+	answers := make(chan answer, len(neighbors))
+	for i, n := range neighbors {
+		go func(i int, n NodeData) {
+			r, _ := n.SimilarImages(hash, phash, distance, key)
+			if n.recentlyFailed() {
+				// couldn't reach it at all, rather than
+				// just not liking what we asked
+				ctx.Cluster.FailedNeighbor(n)
+			}
+			answers <- answer{i, r}
+		}(i, n)
+	}
+	results := make([]*SimilarImages, len(neighbors))
+	answered := make([]bool, len(neighbors))
+	deadline := time.After(similarTimeout)
+	for range neighbors {
+		select {
+		case a := <-answers:
+			results[a.i] = a.r
+			answered[a.i] = a.r != nil
+		case <-deadline:
+			return results, answered
+		}
+	}
+	return results, answered
+}
+
+// the neighbors worth asking about an upload: ones that are
+// taking images, and haven't let us down since we last heard
+// from them. The upload can't wait around for the rest.
+func (ctx Context) uploadNeighbors() []NodeData {
+	neighbors := make([]NodeData, 0)
+	for _, n := range ctx.Cluster.GetNeighbors() {
+		if n.Writeable && !n.recentlyFailed() {
+			neighbors = append(neighbors, n)
+		}
+	}
+	return neighbors
+}
+
+// the upload side: nothing to report if there's no policy,
+// or we couldn't work out what the image looks like.
+func (ctx Context) nearDuplicates(img *ingestedImage, policy, key string) ([]SimilarImage, error) {
+	if policy == "" || img.PerceptualHash == "" {
+		return nil, nil
+	}
+	phash, err := parsePerceptualHash(img.PerceptualHash)
+	if err != nil {
+		return nil, nil
+	}
+	similar := ctx.similarImages(img.Hash.String(), phash, ctx.Cfg.NearDuplicateDistance, ctx.uploadNeighbors(), key).Images
+	if policy == nearDuplicatesReject && len(similar) > 0 {
+		var hashes []string
+		for _, s := range similar {
+			hashes = append(hashes, s.Hash)
+		}
+		return nil, uploadError{409, "near duplicate of " + strings.Join(hashes, ", ")}
+	}
+	return similar, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encodedPatternImage(seed int64, w, h int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, patternImage(seed, w, h))
+	return buf.Bytes()
+}
+
+func Test_SimilarityIndex(t *testing.T) {
+	s := NewSimilarityIndex(NewMemoryStore())
+	a, _ := ingestImage(s, bytes.NewReader(encodedPatternImage(1, 60, 50)), "", "", ImageLimits{})
+	if a.PerceptualHash == "" {
+		t.Fatal("should have worked out a perceptual hash")
+	}
+	hash := a.Hash
+	s.PutMetadata(hash, ImageMetadata{Hash: hash.String(), Extension: "png", PerceptualHash: a.PerceptualHash})
+	phash, ok := s.Lookup(hash.String())
+	if !ok || formatPerceptualHash(phash) != a.PerceptualHash {
+		t.Error("metadata going in should have been indexed")
+	}
+	if len(s.Near(phash, 0, "")) != 1 || len(s.Near(phash, 64, hash.String())) != 0 {
+		t.Error("wrong results from Near")
+	}
+
+	// a fresh index picks up what's already there
+	fresh := NewSimilarityIndex(s.Store)
+	fresh.Load(DummyLogger{})
+	if _, ok := fresh.Lookup(hash.String()); !ok {
+		t.Error("Load should have found it")
+	}
+
+	s.DeleteAll(hash)
+	if _, ok := s.Lookup(hash.String()); ok {
+		t.Error("deleted image should be out of the index")
+	}
+}
+
+func Test_mergeSimilar(t *testing.T) {
+	a := &SimilarImages{Images: []SimilarImage{{Hash: "b", Distance: 3}, {Hash: "a", Distance: 3}}}
+	b := &SimilarImages{Images: []SimilarImage{{Hash: "b", Distance: 3}, {Hash: "c", Distance: 1}}}
+	merged := mergeSimilar([]*SimilarImages{a, b}, []string{"one", "two"})
+	if len(merged) != 3 || merged[0].Hash != "c" || merged[1].Hash != "a" {
+		t.Errorf("wrong order: %+v", merged)
+	}
+	if len(merged[2].Nodes) != 2 {
+		t.Error("should know both nodes have b")
+	}
+}
+
+func Test_uploadNearDuplicates(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+
+	first, err := ctx.upload(bytes.NewReader(encodedPatternImage(1, 120, 100)), ImageMetadata{}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same picture at a different size is different bytes
+	resized := encodedPatternImage(1, 60, 50)
+	_, err = ctx.upload(bytes.NewReader(resized), ImageMetadata{}, "", "reject", "")
+	if ue, ok := err.(uploadError); !ok || ue.Status != 409 {
+		t.Errorf("near duplicate should have been rejected: %v", err)
+	}
+	id, err := ctx.upload(bytes.NewReader(resized), ImageMetadata{}, "", "flag", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id.Similar) != 1 || id.Similar[0].Hash != first.Hash {
+		t.Errorf("near duplicate should have been flagged: %+v", id.Similar)
+	}
+	flagged := id.Hash
+	id, err = ctx.upload(bytes.NewReader(encodedPatternImage(2, 120, 100)), ImageMetadata{}, "", "reject", "")
+	if err != nil || len(id.Similar) != 0 {
+		t.Error("a different image isn't a near duplicate")
+	}
+	_, err = ctx.upload(bytes.NewReader(resized), ImageMetadata{}, "", "maybe", "")
+	if ue, ok := err.(uploadError); !ok || ue.Status != 400 {
+		t.Error("unknown policy should be a 400")
+	}
+
+	// and the endpoint finds the flagged one
+	r := httptest.NewRequest("GET", "/similar/"+first.Hash+"/?key=sekrit", nil)
+	w := httptest.NewRecorder()
+	SimilarHandler(w, r, ctx)
+	var similar SimilarImages
+	json.Unmarshal(w.Body.Bytes(), &similar)
+	if w.Code != 200 || len(similar.Images) != 1 || similar.Images[0].Hash != flagged {
+		t.Errorf("wrong /similar/ response: %d %s", w.Code, w.Body.String())
+	}
+	r = httptest.NewRequest("GET", "/similar/"+first.Hash+"/?key=sekrit&distance=0", nil)
+	w = httptest.NewRecorder()
+	SimilarHandler(w, r, ctx)
+	json.Unmarshal(w.Body.Bytes(), &similar)
+	if similar.Distance != 0 {
+		t.Error("distance should have been taken from the query")
+	}
+
+	r = httptest.NewRequest("GET", "/similar/"+first.Hash+"/", nil)
+	w = httptest.NewRecorder()
+	SimilarHandler(w, r, ctx)
+	if w.Code != 403 {
+		t.Error("key should be required")
+	}
+	r = httptest.NewRequest("GET", "/similar/fb682e05b9be61797601e60165825c0b089f755e/?key=sekrit", nil)
+	w = httptest.NewRecorder()
+	SimilarHandler(w, r, ctx)
+	if w.Code != 404 {
+		t.Error("unknown image should be a 404")
+	}
+}
+
+// uploads only ask the neighbors likely to answer, all at once,
+// and don't wait on a slow one for longer than similarTimeout
+func Test_uploadNeighborsSimilar(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	defer func(d time.Duration) { similarTimeout = d }(similarTimeout)
+	similarTimeout = 200 * time.Millisecond
+
+	release := make(chan bool)
+	var asked int32
+	var servers []*httptest.Server
+	defer func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}()
+	neighbor := func(nickname string, answer func(w http.ResponseWriter)) NodeData {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&asked, 1)
+			answer(w)
+		}))
+		servers = append(servers, srv)
+		return NodeData{Nickname: nickname, UUID: nickname + "-uuid", BaseUrl: srv.URL,
+			Writeable: true, LastSeen: time.Now()}
+	}
+	found := func(w http.ResponseWriter) {
+		w.Write([]byte(`{"images": [{"hash": "fb682e05b9be61797601e60165825c0b089f755e", "extension": ".png", "distance": 1}]}`))
+	}
+	ctx.Cluster.AddNeighbor(neighbor("fast", found))
+	ctx.Cluster.AddNeighbor(neighbor("slow", func(w http.ResponseWriter) {
+		<-release
+		found(w)
+	}))
+	readOnly := neighbor("readonly", found)
+	readOnly.Writeable = false
+	ctx.Cluster.AddNeighbor(readOnly)
+	failed := neighbor("failed", found)
+	failed.LastFailed = failed.LastSeen.Add(time.Second)
+	ctx.Cluster.AddNeighbor(failed)
+	defer close(release)
+
+	start := time.Now()
+	similar := ctx.similarImages("ae28605f0ffc34fe5314342f78efaa13ee45f699", 0, 4, ctx.uploadNeighbors(), "")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v on the slow neighbor", elapsed)
+	}
+	if len(similar.Images) != 1 || len(similar.Images[0].Nodes) != 1 || similar.Images[0].Nodes[0] != "fast" {
+		t.Errorf("should have heard back from the fast neighbor: %+v", similar.Images)
+	}
+	if len(similar.Unreachable) != 1 || similar.Unreachable[0] != "slow" {
+		t.Errorf("slow neighbor should have been unreachable: %v", similar.Unreachable)
+	}
+	if n := atomic.LoadInt32(&asked); n != 2 {
+		t.Errorf("read only and failed neighbors shouldn't have been asked: %d asked", n)
+	}
+}
+
+func Test_repairMetadataBackfillsPerceptualHash(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	img, _ := ingestImage(ctx.Store, bytes.NewReader(encodedPatternImage(4, 30, 30)), "", "", ImageLimits{})
+	// written before perceptual hashes were a thing
+	ctx.Store.PutMetadata(img.Hash, ImageMetadata{Hash: img.Hash.String(), Extension: "png", Filename: "old.png"})
+	if err := repair_metadata(ctx.Store, img.original(), ctx.Cluster, DummyLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := ctx.Store.GetMetadata(img.Hash)
+	if m.PerceptualHash != img.PerceptualHash || m.Filename != "old.png" {
+		t.Error("should have filled in just the perceptual hash")
+	}
+	if _, ok := ctx.Similar.Lookup(img.Hash.String()); !ok {
+		t.Error("backfilled hash should be in the index")
+	}
+}
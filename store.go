@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// where originals and their derivatives actually live. Everything
+// is keyed by ImageSpecifier; a Size of "full" is the original.
+// Missing images are reported with errors that os.IsNotExist
+// recognizes, whatever the backend.
+type Store interface {
+	// originals must hash to ri.Hash, or nothing is stored
+	Put(ri *ImageSpecifier, r io.Reader) error
+	Get(ri *ImageSpecifier) (io.ReadCloser, error)
+	// length in bytes
+	Stat(ri *ImageSpecifier) (int64, error)
+	// everything stored for the hash, original included
+	Entries(hash *Hash) ([]*ImageSpecifier, error)
+	// calls fn on each original whose hash sorts after the given
+	// one, in hash order. if fn returns an error, that stops the
+	// walk and List returns it.
+	List(after string, fn func(ri *ImageSpecifier) error) error
+	Delete(ri *ImageSpecifier) error
+	// the original, all derivatives, and the metadata
+	DeleteAll(hash *Hash) error
+	GetMetadata(hash *Hash) (*ImageMetadata, error)
+	PutMetadata(hash *Hash, m ImageMetadata) error
+}
+
+// one way of walking some originals in hash order, like List
+type walker func(fn func(ri *ImageSpecifier) error) error
+
+// tells a walk that nobody wants the rest of it
+var errWalkStopped = errors.New("walk stopped")
+
+// runs several walks at once and calls fn on everything they
+// find, still in hash order. A hash found by more than one of
+// them only gets passed along once.
+func mergeWalks(walks []walker, fn func(ri *ImageSpecifier) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	streams := make([]chan *ImageSpecifier, len(walks))
+	for i, walk := range walks {
+		ch := make(chan *ImageSpecifier)
+		streams[i] = ch
+		go func(walk walker) {
+			defer close(ch)
+			walk(func(ri *ImageSpecifier) error {
+				select {
+				case ch <- ri:
+					return nil
+				case <-done:
+					return errWalkStopped
+				}
+			})
+		}(walk)
+	}
+	heads := make([]*ImageSpecifier, len(streams))
+	for i, ch := range streams {
+		heads[i] = <-ch
+	}
+	last := ""
+	for {
+		next := -1
+		for i, ri := range heads {
+			if ri != nil && (next == -1 || ri.Hash.String() < heads[next].Hash.String()) {
+				next = i
+			}
+		}
+		if next == -1 {
+			return nil
+		}
+		ri := heads[next]
+		heads[next] = <-streams[next]
+		if ri.Hash.String() == last {
+			continue
+		}
+		last = ri.Hash.String()
+		err := fn(ri)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// we don't always know the extension of the original,
+// so go looking for it
+func findOriginal(st Store, hash *Hash) (*ImageSpecifier, bool) {
+	entries, err := st.Entries(hash)
+	if err != nil {
+		return nil, false
+	}
+	for _, ri := range entries {
+		if ri.Size.IsFull() {
+			return ri, true
+		}
+	}
+	return nil, false
+}
+
+// originals are only ever one of the formats we can decode
+func originalFormat(ext string) bool {
+	_, ok := decoders[strings.TrimPrefix(ext, ".")]
+	return ok
+}
+
+// what a derivative gets made from, if we have it. The extension
+// is only the format it's wanted in, so the original can be in
+// any format, though one in the same format is quickest to find.
+// A full size only ever comes from itself; making one in another
+// format would leave it looking like a second original (those
+// are asked for at the original's size instead, see fullSizeIn).
+func originalFor(st Store, ri *ImageSpecifier) (*ImageSpecifier, error) {
+	orig := ri.fullSize()
+	_, err := st.Stat(orig)
+	if err == nil || ri.Size.IsFull() {
+		return orig, err
+	}
+	orig, ok := findOriginal(st, ri.Hash)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return orig, nil
+}
+
+func readAll(st Store, ri *ImageSpecifier) ([]byte, error) {
+	r, err := st.Get(ri)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// for stores that hold the whole thing in memory
+// before they commit to it
+func checkDigest(b []byte, expected *Hash) error {
+	h := expected.NewDigest()
+	h.Write(b)
+	digest := fmt.Sprintf("%x", h.Sum(nil))
+	if digest != expected.String() {
+		return errors.New(fmt.Sprintf("digest mismatch storing %s: got %s", expected.String(), digest))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/thraxil/resize"
+)
+
+// the same checks, run against every Store implementation
+func storeConformance(t *testing.T, st Store) {
+	contents := encodedTestImage("png", 6, 6)
+	img, err := examineUpload(bytes.NewReader(contents), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := img.original()
+	thumb := &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("100s"), Extension: ".png"}
+
+	if _, err := st.Stat(orig); !os.IsNotExist(err) {
+		t.Error("empty store should not have it")
+	}
+	if _, err := st.Get(orig); !os.IsNotExist(err) {
+		t.Error("empty store should not have it")
+	}
+
+	err = st.Put(orig, bytes.NewReader([]byte("not what it hashes to")))
+	if err == nil {
+		t.Error("original with the wrong digest should be refused")
+	}
+	if _, err := st.Stat(orig); !os.IsNotExist(err) {
+		t.Error("refused original should not have been stored")
+	}
+
+	if err := st.Put(orig, bytes.NewReader(contents)); err != nil {
+		t.Fatalf("couldn't store original: %s", err)
+	}
+	// derivatives don't hash to anything in particular
+	if err := st.Put(thumb, bytes.NewReader([]byte("thumbnail"))); err != nil {
+		t.Fatalf("couldn't store derivative: %s", err)
+	}
+	if n, err := st.Stat(orig); err != nil || n != int64(len(contents)) {
+		t.Error("wrong length for original")
+	}
+	b, err := readAll(st, thumb)
+	if err != nil || string(b) != "thumbnail" {
+		t.Error("didn't get the derivative back")
+	}
+
+	entries, err := st.Entries(img.Hash)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d (%v)", len(entries), err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.filename())
+	}
+	sort.Strings(names)
+	if names[0] != "100s.png" || names[1] != "full.png" {
+		t.Errorf("wrong entries: %v", names)
+	}
+	if ri, ok := findOriginal(st, img.Hash); !ok || ri.Extension != ".png" {
+		t.Error("couldn't find the original")
+	}
+	for spec, expected := range map[string]string{"100s.png": ".png", "100s.webp": ".png", "100s.jpg": ".png", "full.jpg": ""} {
+		ri := &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec(basename(spec)), Extension: filepath.Ext(spec)}
+		orig, err := originalFor(st, ri)
+		if expected == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("there's no original for %s", spec)
+			}
+			continue
+		}
+		if err != nil || orig.Extension != expected || !orig.Size.IsFull() {
+			t.Errorf("wrong original for %s: %v %v", spec, orig, err)
+		}
+	}
+
+	if err := st.PutMetadata(img.Hash, ImageMetadata{Hash: img.Hash.String(), Filename: "x.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := st.GetMetadata(img.Hash); err != nil || m.Filename != "x.png" {
+		t.Error("didn't get the metadata back")
+	}
+
+	// a second original, to check ordering and the cursor
+	other, _ := ingestImage(st, bytes.NewReader(encodedTestImage("gif", 3, 3)), "", "", ImageLimits{})
+	var listed []string
+	err = st.List("", func(ri *ImageSpecifier) error {
+		if !ri.Size.IsFull() {
+			t.Error("List should only give originals")
+		}
+		listed = append(listed, ri.Hash.String())
+		return nil
+	})
+	if err != nil || len(listed) != 2 || listed[0] > listed[1] {
+		t.Errorf("wrong listing: %v %v", listed, err)
+	}
+	listed = nil
+	st.List(firstHash(img.Hash.String(), other.Hash.String()), func(ri *ImageSpecifier) error {
+		listed = append(listed, ri.Hash.String())
+		return nil
+	})
+	if len(listed) != 1 {
+		t.Error("cursor should have skipped the first")
+	}
+	stop := errors.New("stop")
+	if st.List("", func(ri *ImageSpecifier) error { return stop }) != stop {
+		t.Error("List should hand back the error that stopped it")
+	}
+
+	if err := st.Delete(thumb); err != nil {
+		t.Error(err)
+	}
+	if _, err := st.Stat(thumb); !os.IsNotExist(err) {
+		t.Error("derivative should be gone")
+	}
+	if err := st.DeleteAll(img.Hash); err != nil {
+		t.Error(err)
+	}
+	if _, err := st.Stat(orig); !os.IsNotExist(err) {
+		t.Error("original should be gone")
+	}
+	if _, err := st.GetMetadata(img.Hash); err == nil {
+		t.Error("metadata should be gone")
+	}
+	if _, err := st.Stat(other.original()); err != nil {
+		t.Error("DeleteAll took out a different image")
+	}
+}
+
+// whichever of the two sorts first
+func firstHash(a, b string) string {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func Test_DiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storeConformance(t, NewDiskStore(dir+"/"))
+}
+
+// a hash that isn't one (HashFromString won't make these any
+// more) mustn't get DeleteAll out of the upload directory
+func Test_DiskStoreDeleteAllStaysInRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "uploads") + "/"
+	os.MkdirAll(root, 0755)
+	st := NewDiskStore(root)
+	err = st.DeleteAll(&Hash{"sha1", []byte("........................................")})
+	if err == nil {
+		t.Error("DeleteAll should refuse a path outside the root")
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Error("DeleteAll removed the upload directory")
+	}
+}
+
+// sha1 and sha256 images live in different trees, but
+// should still come out of List in hash order
+func Test_DiskStoreMixedAlgorithms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := NewDiskStore(dir + "/")
+	var hashes []string
+	for i, algorithm := range []string{"sha1", "sha256", "sha1", "sha256"} {
+		img, err := ingestImage(st, bytes.NewReader(encodedTestImage("png", i+1, 1)), "", algorithm, ImageLimits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, img.Hash.String())
+	}
+	sort.Strings(hashes)
+	var listed []string
+	st.List("", func(ri *ImageSpecifier) error {
+		listed = append(listed, ri.Hash.String())
+		return nil
+	})
+	if len(listed) != 4 {
+		t.Fatalf("expected all 4 listed, got %v", listed)
+	}
+	for i := range listed {
+		if listed[i] != hashes[i] {
+			t.Errorf("out of order: %v", listed)
+			break
+		}
+	}
+	listed = nil
+	st.List(hashes[1], func(ri *ImageSpecifier) error {
+		listed = append(listed, ri.Hash.String())
+		return nil
+	})
+	if len(listed) != 2 || listed[0] != hashes[2] {
+		t.Errorf("cursor didn't work across algorithms: %v", listed)
+	}
+}
+
+func Test_MemoryStore(t *testing.T) {
+	storeConformance(t, NewMemoryStore())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// a record that an image was deliberately deleted. These get
+// gossiped around the cluster so that replication and repair
+// don't resurrect it from some other node's copy.
+//
+// Since hearing about one is enough to make a node throw its
+// copy away, each is signed with an upload key by the node
+// where the deletion happened, and nobody takes one that isn't.
+type Tombstone struct {
+	Hash      string    `json:"hash"`
+	Deleted   time.Time `json:"deleted"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+func (t Tombstone) mac(key string) []byte {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write([]byte(t.Hash + "\n" + t.Deleted.UTC().Format(time.RFC3339Nano)))
+	return m.Sum(nil)
+}
+
+// signed with the first of keys. Without any, deleting
+// isn't allowed, so it's left unsigned.
+func (t Tombstone) signed(keys []string) Tombstone {
+	if len(keys) > 0 {
+		t.Signature = hex.EncodeToString(t.mac(keys[0]))
+	}
+	return t
+}
+
+// whether it was signed with any of keys
+func (t Tombstone) signedWith(keys []string) bool {
+	sig, err := hex.DecodeString(t.Signature)
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	for _, key := range keys {
+		if hmac.Equal(sig, t.mac(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reads the tombstone journal (one JSON Tombstone per line) and
+// remembers where it is so new tombstones get appended to it.
+// a missing journal just means nothing has been deleted yet.
+// The journal is our own, so what's in it is trusted; entries
+// from before tombstones were signed get signed now, so that
+// the rest of the cluster will take them.
+func (c *Cluster) LoadTombstones(journal string) error {
+	var loaded []Tombstone
+	f, err := os.Open(journal)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var t Tombstone
+			if json.Unmarshal(scanner.Bytes(), &t) == nil && t.Hash != "" {
+				if t.Signature == "" {
+					t = t.signed(c.TombstoneKeys)
+				}
+				loaded = append(loaded, t)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	done := make(chan bool)
+	c.chF <- func() {
+		for _, t := range loaded {
+			c.tombstones[t.Hash] = t
+		}
+		c.tombstoneJournal = journal
+		done <- true
+	}
+	<-done
+	return err
+}
+
+// records a tombstone. returns true if it's one we didn't
+// already know about. Ones that aren't signed with one of
+// TombstoneKeys are turned away.
+func (c *Cluster) AddTombstone(t Tombstone) bool {
+	if !t.signedWith(c.TombstoneKeys) {
+		return false
+	}
+	r := make(chan bool)
+	go func() {
+		c.chF <- func() {
+			if _, ok := c.tombstones[t.Hash]; ok {
+				r <- false
+				return
+			}
+			c.tombstones[t.Hash] = t
+			c.appendTombstone(t)
+			r <- true
+		}
+	}()
+	return <-r
+}
+
+// only ever called from the backend goroutine
+func (c *Cluster) appendTombstone(t Tombstone) {
+	if c.tombstoneJournal == "" {
+		return
+	}
+	f, err := os.OpenFile(c.tombstoneJournal, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	b, _ := json.Marshal(t)
+	f.Write(append(b, '\n'))
+	f.Sync()
+}
+
+func (c *Cluster) Tombstoned(hash string) bool {
+	r := make(chan bool)
+	go func() {
+		c.chF <- func() {
+			_, ok := c.tombstones[hash]
+			r <- ok
+		}
+	}()
+	return <-r
+}
+
+// a local tombstone, signed so the rest of the cluster believes it
+func (c *Cluster) NewTombstone(hash string, deleted time.Time) Tombstone {
+	return Tombstone{Hash: hash, Deleted: deleted}.signed(c.TombstoneKeys)
+}
+
+func (c *Cluster) GetTombstones() []Tombstone {
+	return c.TombstonesSince(time.Time{})
+}
+
+// the tombstones for anything deleted after since. Gossip mostly
+// passes just these on: the list never shrinks, and sending all
+// of it on every announce would get slower forever. Older ones
+// are still kept here, so we go on refusing those images, and
+// nodes that have been away long enough to miss them get them.
+func (c *Cluster) TombstonesSince(since time.Time) []Tombstone {
+	r := make(chan []Tombstone)
+	go func() {
+		c.chF <- func() {
+			ts := make([]Tombstone, 0)
+			for _, t := range c.tombstones {
+				if t.Deleted.After(since) {
+					ts = append(ts, t)
+				}
+			}
+			r <- ts
+		}
+	}()
+	return <-r
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Tombstones(t *testing.T) {
+	_, c := makeNewClusterData(make([]NodeData, 0))
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := dir + "/tombstones"
+	c.TombstoneKeys = []string{"sekrit"}
+
+	err = c.LoadTombstones(journal)
+	if err != nil {
+		t.Error("missing journal should not be an error")
+	}
+	hash := "fb682e05b9be61797601e60165825c0b089f755e"
+	if c.Tombstoned(hash) {
+		t.Error("nothing deleted yet")
+	}
+	if !c.AddTombstone(c.NewTombstone(hash, time.Now())) {
+		t.Error("should have been a new tombstone")
+	}
+	if c.AddTombstone(c.NewTombstone(hash, time.Now())) {
+		t.Error("already knew about that one")
+	}
+	if !c.Tombstoned(hash) {
+		t.Error("should be tombstoned now")
+	}
+	if len(c.GetTombstones()) != 1 {
+		t.Error("should only be one tombstone")
+	}
+
+	// start over and make sure it comes back from the journal
+	_, c = makeNewClusterData(make([]NodeData, 0))
+	c.TombstoneKeys = []string{"sekrit"}
+	if c.Tombstoned(hash) {
+		t.Error("should have been cleared")
+	}
+	err = c.LoadTombstones(journal)
+	if err != nil {
+		t.Errorf("couldn't load journal: %s", err)
+	}
+	if !c.Tombstoned(hash) {
+		t.Error("tombstone didn't survive a reload")
+	}
+}
+
+// anyone can claim to be a node, so only tombstones
+// signed with an upload key count
+func Test_TombstoneSignatures(t *testing.T) {
+	_, c := makeNewClusterData(make([]NodeData, 0))
+	hash := "fb682e05b9be61797601e60165825c0b089f755e"
+	if c.AddTombstone(Tombstone{Hash: hash, Deleted: time.Now()}) {
+		t.Error("unsigned tombstone shouldn't be taken")
+	}
+	c.TombstoneKeys = []string{"old", "sekrit"}
+	forged := Tombstone{Hash: hash, Deleted: time.Now()}.signed([]string{"wrong"})
+	if c.AddTombstone(forged) {
+		t.Error("tombstone signed with the wrong key shouldn't be taken")
+	}
+	// signed with the other key, and it's been through JSON
+	// on the way here
+	b, _ := json.Marshal(Tombstone{Hash: hash, Deleted: time.Now()}.signed([]string{"sekrit"}))
+	var gossiped Tombstone
+	json.Unmarshal(b, &gossiped)
+	if !c.AddTombstone(gossiped) {
+		t.Error("should take a tombstone signed with any of the keys")
+	}
+	tampered := gossiped
+	tampered.Hash = "ae28605f0ffc34fe5314342f78efaa13ee45f699"
+	if c.AddTombstone(tampered) {
+		t.Error("signature shouldn't carry over to another hash")
+	}
+	if c.Tombstoned(tampered.Hash) {
+		t.Error("should only have the one tombstone")
+	}
+}
+
+func Test_TombstonesSince(t *testing.T) {
+	_, c := makeNewClusterData(make([]NodeData, 0))
+	c.TombstoneKeys = []string{"sekrit"}
+	c.AddTombstone(c.NewTombstone("fb682e05b9be61797601e60165825c0b089f755e", time.Now().Add(-48*time.Hour)))
+	c.AddTombstone(c.NewTombstone("ae28605f0ffc34fe5314342f78efaa13ee45f699", time.Now()))
+	recent := c.TombstonesSince(time.Now().Add(-24 * time.Hour))
+	if len(recent) != 1 || recent[0].Hash != "ae28605f0ffc34fe5314342f78efaa13ee45f699" {
+		t.Errorf("wrong tombstones: %v", recent)
+	}
+	if len(c.GetTombstones()) != 2 {
+		t.Error("older ones should still be kept")
+	}
+	if !c.Tombstoned("fb682e05b9be61797601e60165825c0b089f755e") {
+		t.Error("older ones should still count")
+	}
+}
+
+func Test_AnnounceTombstones(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	old := "fb682e05b9be61797601e60165825c0b089f755e"
+	ctx.Cluster.AddTombstone(ctx.Cluster.NewTombstone(old, time.Now().Add(-60*24*time.Hour)))
+	ctx.Cluster.AddTombstone(ctx.Cluster.NewTombstone("ae28605f0ffc34fe5314342f78efaa13ee45f699", time.Now()))
+
+	announce := func(n NodeData) []Tombstone {
+		r := httptest.NewRequest("POST", "/announce/", strings.NewReader(makeParams(n).Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		AnnounceHandler(w, r, ctx)
+		var ar AnnounceResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &ar); err != nil {
+			t.Fatal(err)
+		}
+		return ar.Tombstones
+	}
+	n := NodeData{Nickname: "new", UUID: "new-uuid", BaseUrl: "localhost:8081"}
+	if len(announce(n)) != 2 {
+		t.Error("a new node should hear about every deletion")
+	}
+	if ts := announce(n); len(ts) != 1 || ts[0].Hash == old {
+		t.Errorf("after that, only the recent ones: %v", ts)
+	}
+
+	// down for longer than TombstoneGossipDays, and now it's back
+	away := NodeData{Nickname: "away", UUID: "away-uuid", BaseUrl: "localhost:8082",
+		LastSeen: time.Now().Add(-45 * 24 * time.Hour)}
+	ctx.Cluster.AddNeighbor(away)
+	if len(announce(away)) != 2 {
+		t.Error("a node back from a long absence should catch up on everything")
+	}
+	if len(announce(away)) != 1 {
+		t.Error("once it's caught up, only the recent ones")
+	}
+}
@@ -1,15 +1,12 @@
 package main
 
 import (
-	"crypto/sha1"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
-	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/thraxil/resize"
@@ -26,39 +23,32 @@ func basename(path string) string {
 // expects a filename at the end. otherwise, there can be
 // arbitrarily many extra path components on the front
 func hashFromPath(path string) (string, error) {
-	dir := filepath.Dir(path)
-	parts := strings.Split(dir, "/")
-	// only want the last 20 parts
-	if len(parts) < 20 {
-		return "", errors.New("not enough parts")
-	}
-	hash := strings.Join(parts[len(parts)-20:], "")
-	if len(hash) != 40 {
-		return "", errors.New(fmt.Sprintf("invalid hash length: %d (%s)", len(hash), hash))
+	hash, err := HashFromPath(path)
+	if err != nil {
+		return "", err
 	}
-	return hash, nil
+	return hash.String(), nil
 }
 
 // checks the image for corruption
 // if it is corrupt, try to repair
-func verify(path string, extension string, hash *Hash, ahash string,
-	c *Cluster, sl Logger) error {
+func verify(ri *ImageSpecifier, ahash string, c *Cluster, st Store, sl Logger) error {
 	//    VERIFY PHASE
-	if hash.String() != ahash {
-		sl.Warning(fmt.Sprintf("image %s appears to be corrupted!\n", path))
+	if ri.Hash.String() != ahash {
+		sl.Warning(fmt.Sprintf("image %s appears to be corrupted!\n", ri.String()))
 		// trust that the hash was correct on upload
 		// ask other nodes for a copy
-		repaired, err := repair_image(path, extension, hash, c, sl)
+		repaired, err := repair_image(ri, c, st, sl)
 		if err != nil {
 			return err
 		}
 		if repaired {
-			err := clear_cached(path, extension)
+			err := clear_cached(st, ri)
 			if err != nil {
 				return err
 			}
 		} else {
-			sl.Err(fmt.Sprintf("could not repair corrupted image: %s\n", path))
+			sl.Err(fmt.Sprintf("could not repair corrupted image: %s\n", ri.String()))
 			// return here so we don't try to rebalance a corrupted image
 			return errors.New("unrepairable image")
 		}
@@ -67,15 +57,14 @@ func verify(path string, extension string, hash *Hash, ahash string,
 }
 
 // do our best to repair the image
-func repair_image(path string, extension string, hash *Hash,
-	c *Cluster, sl Logger) (bool, error) {
-	nodes_to_check := c.ReadOrder(hash.String())
+func repair_image(ri *ImageSpecifier, c *Cluster, st Store, sl Logger) (bool, error) {
+	nodes_to_check := c.ReadOrder(ri.Hash.String())
 	for _, n := range nodes_to_check {
 		if n.UUID == c.Myself.UUID {
 			// skip ourself, since we know we are corrupt
 			continue
 		}
-		cont, ret, err := checkImageOnNode(n, hash, extension, path, c, sl)
+		cont, ret, err := checkImageOnNode(n, ri, st, sl)
 		if !cont {
 			return ret, err
 		}
@@ -83,69 +72,48 @@ func repair_image(path string, extension string, hash *Hash,
 	return false, nil
 }
 
-func replaceImageWithCorrected(path string, img []byte, sl Logger) (bool, bool, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		// can't open for writing!
-		sl.Err(fmt.Sprintf("could not open for writing: %s, %s\n", path, err))
-		f.Close()
-		return false, false, err
-	}
-	_, err = f.Write(img)
-	f.Close()
+func replaceImageWithCorrected(st Store, ri *ImageSpecifier, img []byte, sl Logger) (bool, bool, error) {
+	err := st.Put(ri, bytes.NewReader(img))
 	if err != nil {
-		sl.Err(fmt.Sprintf("could not write: %s, %s\n", path, err))
+		sl.Err(fmt.Sprintf("could not write: %s, %s\n", ri.String(), err))
 		return false, false, err
 	}
 	return false, true, nil
 }
 
-func checkImageOnNode(n NodeData, hash *Hash, extension string, path string,
-	c *Cluster, sl Logger) (bool, bool, error) {
-	s := resize.MakeSizeSpec("full")
-	ri := &ImageSpecifier{hash, s, extension}
-
+func checkImageOnNode(n NodeData, ri *ImageSpecifier, st Store, sl Logger) (bool, bool, error) {
 	img, err := n.RetrieveImage(ri)
 	if err != nil {
 		// doesn't have it
 		sl.Info(fmt.Sprintf("node %s does not have a copy of the desired image\n", n.Nickname))
 		return true, true, nil
 	} else {
-		if !doublecheck_replica(img, hash) {
+		if !doublecheck_replica(img, ri.Hash) {
 			// the copy from that node isn't right either
 			return true, true, nil
 		}
-		return replaceImageWithCorrected(path, img, sl)
+		return replaceImageWithCorrected(st, ri, img, sl)
 	}
 }
 
 func doublecheck_replica(img []byte, hash *Hash) bool {
-	hn := sha1.New()
-	io.WriteString(hn, string(img))
-	nhash := fmt.Sprintf("%x", hn.Sum(nil))
-	return nhash == hash.String()
-}
-
-// the only File methods that we care about
-// makes it easier to mock
-type FileIsh interface {
-	IsDir() bool
-	Name() string
+	return hash.Matches(img)
 }
 
 // cached sizes may have been created off the broken one
 // and the easiest solution is to take off
 // and nuke the site from orbit. It's the only way to be sure.
-func clear_cached(path string, extension string) error {
-	files, err := ioutil.ReadDir(filepath.Dir(path))
+func clear_cached(st Store, ri *ImageSpecifier) error {
+	entries, err := st.Entries(ri.Hash)
 	if err != nil {
-		// can't read the dir?!
 		return err
 	}
 	var successful_purge = true
-	for _, file := range files {
-		r := func(p string) error { return os.Remove(p) }
-		err = clear_cached_file(file, path, extension, r)
+	for _, e := range entries {
+		if e.Size.IsFull() {
+			continue
+		}
+		err = st.Delete(e)
 		successful_purge = successful_purge && (err == nil)
 	}
 	if !successful_purge {
@@ -155,29 +123,16 @@ func clear_cached(path string, extension string) error {
 	return nil
 }
 
-type remover func(fullpath string) error
-
-func clear_cached_file(file FileIsh, path, extension string, r remover) error {
-	if file.IsDir() {
-		return nil
-	}
-	if file.Name() == "full"+extension {
-		return nil
-	}
-	return r(filepath.Join(filepath.Dir(path), file.Name()))
-}
-
 type ImageRebalancer struct {
-	c         *Cluster
-	s         SiteConfig
-	sl        Logger
-	hash      *Hash
-	path      string
-	extension string
+	c  *Cluster
+	s  SiteConfig
+	sl Logger
+	st Store
+	ri *ImageSpecifier
 }
 
-func NewImageRebalancer(path, extension string, hash *Hash, c *Cluster, s SiteConfig, sl Logger) *ImageRebalancer {
-	return &ImageRebalancer{c, s, sl, hash, path, extension}
+func NewImageRebalancer(ri *ImageSpecifier, c *Cluster, s SiteConfig, sl Logger, st Store) *ImageRebalancer {
+	return &ImageRebalancer{c, s, sl, st, ri}
 }
 
 // check that the image is stored in at least Replication nodes
@@ -189,15 +144,19 @@ func (r ImageRebalancer) Rebalance() error {
 		r.sl.Err("rebalance was given a nil cluster")
 		return errors.New("nil cluster")
 	}
-	nodes_to_check := r.c.ReadOrder(r.hash.String())
+	if r.c.Tombstoned(r.ri.Hash.String()) {
+		// never re-replicate something that was deleted
+		return nil
+	}
+	nodes_to_check := r.c.ReadOrder(r.ri.Hash.String())
 	satisfied, delete_local, found_replicas := r.checkNodesForRebalance(nodes_to_check)
 	if !satisfied {
-		r.sl.Warning(fmt.Sprintf("could not replicate %s to %d nodes", r.path, r.s.Replication))
+		r.sl.Warning(fmt.Sprintf("could not replicate %s to %d nodes", r.ri.String(), r.s.Replication))
 	} else {
-		r.sl.Info(fmt.Sprintf("%s has full replica set (%d of %d)\n", r.path, found_replicas, r.s.Replication))
+		r.sl.Info(fmt.Sprintf("%s has full replica set (%d of %d)\n", r.ri.String(), found_replicas, r.s.Replication))
 	}
 	if satisfied && delete_local {
-		clean_up_excess_replica(r.path, r.sl)
+		clean_up_excess_replica(r.st, r.ri, r.sl)
 	}
 	return nil
 }
@@ -229,14 +188,14 @@ func (r ImageRebalancer) checkNodesForRebalance(nodes_to_check []NodeData) (bool
 }
 
 type StashableNode interface {
-	Stash(filename string, size_hints string) bool
+	Stash(ri *ImageSpecifier, size_hints string, st Store) bool
 	RetrieveImageInfo(ri *ImageSpecifier) (*ImageInfoResponse, error)
 }
 
 func (r ImageRebalancer) retrieveReplica(n StashableNode, satisfied bool) int {
 
 	s := resize.MakeSizeSpec("full")
-	ri := &ImageSpecifier{r.hash, s, r.extension[1:]}
+	ri := &ImageSpecifier{Hash: r.ri.Hash, Size: s, Extension: r.ri.Extension[1:]}
 
 	img_info, err := n.RetrieveImageInfo(ri)
 	if err == nil && img_info != nil && img_info.Local {
@@ -245,8 +204,8 @@ func (r ImageRebalancer) retrieveReplica(n StashableNode, satisfied bool) int {
 	} else {
 		// that node should have a copy, but doesn't so stash it
 		if !satisfied {
-			if n.Stash(r.path, "") {
-				r.sl.Info(fmt.Sprintf("replicated %s\n", r.path))
+			if n.Stash(r.ri, "", r.st) {
+				r.sl.Info(fmt.Sprintf("replicated %s\n", r.ri.String()))
 				return 1
 			} else {
 				// couldn't stash to that node. not writeable perhaps.
@@ -261,37 +220,27 @@ func (r ImageRebalancer) retrieveReplica(n StashableNode, satisfied bool) int {
 
 // our node is not at the front of the list, so
 // we have an excess copy. clean that up and make room!
-func clean_up_excess_replica(path string, sl Logger) {
-	err := os.RemoveAll(filepath.Dir(path))
+func clean_up_excess_replica(st Store, ri *ImageSpecifier, sl Logger) {
+	err := st.DeleteAll(ri.Hash)
 	if err != nil {
-		sl.Err(fmt.Sprintf("could not clear out excess replica: %s\n", path))
+		sl.Err(fmt.Sprintf("could not clear out excess replica: %s\n", ri.String()))
 		sl.Err(err.Error())
 	} else {
-		sl.Info(fmt.Sprintf("cleared excess replica: %s\n", path))
+		sl.Info(fmt.Sprintf("cleared excess replica: %s\n", ri.String()))
 	}
 }
 
-func visitPreChecks(path string, f FileIsh, err error, c *Cluster, sl Logger) (bool, error) {
+func remove_deleted_image(st Store, ri *ImageSpecifier, sl Logger) {
+	err := st.DeleteAll(ri.Hash)
 	if err != nil {
-		sl.Err(fmt.Sprintf("verifier.visit was handed an error: %s", err.Error()))
-		return true, err
-	}
-	if c == nil {
-		sl.Err("verifier.visit was given a nil cluster")
-		return true, errors.New("nil cluster")
-	}
-	// all we care about is the "full" version of each
-	if f.IsDir() {
-		return true, nil
-	}
-	if basename(path) != "full" {
-		return true, nil
+		sl.Err(fmt.Sprintf("could not remove deleted image: %s\n", ri.String()))
+		sl.Err(err.Error())
+	} else {
+		sl.Info(fmt.Sprintf("removed deleted image: %s\n", ri.String()))
 	}
-	return false, nil
 }
 
-func visit(path string, f os.FileInfo, err error, c *Cluster,
-	s SiteConfig, sl Logger) error {
+func visit(ri *ImageSpecifier, c *Cluster, s SiteConfig, st Store, sl Logger) error {
 	// first, if it's our first time through
 	// skip ahead a bunch so every node starts
 	// at a different point and we don't just
@@ -300,43 +249,46 @@ func visit(path string, f os.FileInfo, err error, c *Cluster,
 	if VERIFY_SKIP < VERIFY_OFFSET {
 		return nil
 	}
+	if c == nil {
+		sl.Err("verifier.visit was given a nil cluster")
+		return errors.New("nil cluster")
+	}
 	defer func() {
 		if r := recover(); r != nil {
-			sl.Err(fmt.Sprintf("Error in verifier.visit() [%s] %s", c.Myself.Nickname, path))
+			sl.Err(fmt.Sprintf("Error in verifier.visit() [%s] %s", c.Myself.Nickname, ri.String()))
 			sl.Err(fmt.Sprintf("%v", r))
 		}
 	}()
-	done, err := visitPreChecks(path, f, err, c, sl)
-	if done {
-		return err
-	}
-	extension := filepath.Ext(path)
-	if len(extension) < 2 {
-		return nil
-	}
 
-	hash, err := HashFromPath(path)
-	if err != nil {
+	if c.Tombstoned(ri.Hash.String()) {
+		// deleted, but we still had a copy lying around
+		// (we were down, or only heard about it via gossip)
+		remove_deleted_image(st, ri, sl)
 		return nil
 	}
-	h := sha1.New()
-	imgfile, err := os.Open(path)
-	defer imgfile.Close()
+	// whichever digest it was addressed by
+	h := ri.Hash.NewDigest()
+	imgfile, err := st.Get(ri)
 	if err != nil {
-		sl.Err(fmt.Sprintf("error opening %s", path))
+		sl.Err(fmt.Sprintf("error opening %s", ri.String()))
 		return err
 	}
+	defer imgfile.Close()
 	_, err = io.Copy(h, imgfile)
 	if err != nil {
-		sl.Err(fmt.Sprintf("error copying %s", path))
+		sl.Err(fmt.Sprintf("error copying %s", ri.String()))
 		return err
 	}
 	ahash := fmt.Sprintf("%x", h.Sum(nil))
-	err = verify(path, extension, hash, ahash, c, sl)
+	err = verify(ri, ahash, c, st, sl)
 	if err != nil {
 		return err
 	}
-	r := NewImageRebalancer(path, extension, hash, c, s, sl)
+	err = repair_metadata(st, ri, c, sl)
+	if err != nil {
+		sl.Err(fmt.Sprintf("could not repair metadata for %s: %s", ri.String(), err.Error()))
+	}
+	r := NewImageRebalancer(ri, c, s, sl, st)
 	err = r.Rebalance()
 	if err != nil {
 		return err
@@ -348,15 +300,7 @@ func visit(path string, f os.FileInfo, err error, c *Cluster,
 	return nil
 }
 
-// makes a closure that has access to the cluster and config
-func makeVisitor(fn func(string, os.FileInfo, error, *Cluster, SiteConfig, Logger) error,
-	c *Cluster, s SiteConfig, sl Logger) func(path string, f os.FileInfo, err error) error {
-	return func(path string, f os.FileInfo, err error) error {
-		return fn(path, f, err, c, s, sl)
-	}
-}
-
-func Verify(c *Cluster, s SiteConfig, sl Logger) {
+func Verify(c *Cluster, s SiteConfig, st Store, sl Logger) {
 	sl.Info("starting verifier")
 
 	rand.Seed(int64(time.Now().Unix()) + int64(int(s.Port)))
@@ -369,10 +313,11 @@ func Verify(c *Cluster, s SiteConfig, sl Logger) {
 		sl.Info("verifier starting at the top")
 		sl.Info(fmt.Sprintf("%d/%d", VERIFY_SKIP, VERIFY_OFFSET))
 
-		root := s.UploadDirectory
-		err := filepath.Walk(root, makeVisitor(visit, c, s, sl))
+		err := st.List("", func(ri *ImageSpecifier) error {
+			return visit(ri, c, s, st, sl)
+		})
 		if err != nil {
-			sl.Info(fmt.Sprintf("filepath.Walk() returned %v\n", err))
+			sl.Info(fmt.Sprintf("verifier walk returned %v\n", err))
 		}
 	}
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/thraxil/resize"
 )
 
 func Test_hashFromPath(t *testing.T) {
@@ -46,18 +50,30 @@ type fdummy struct {
 func (f fdummy) IsDir() bool  { return f.DirValue }
 func (f fdummy) Name() string { return f.NameValue }
 
-func Test_clear_cached_file(t *testing.T) {
-	r := func(p string) error { return nil }
-	if clear_cached_file(fdummy{DirValue: true}, "foo", ".jpg", r) != nil {
-		t.Error("clear_cached_file() should not have returned non-nil")
-	}
-	if clear_cached_file(fdummy{DirValue: false, NameValue: "full.jpg"}, "foo", ".jpg", r) != nil {
-		t.Error("clear_cached_file() should not have returned non-nil")
+func Test_clear_cached(t *testing.T) {
+	st := NewMemoryStore()
+	contents := encodedTestImage("png", 4, 4)
+	img, err := ingestImage(st, bytes.NewReader(contents), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if clear_cached_file(fdummy{DirValue: false}, "foo", ".jpg", r) != nil {
-		t.Error("clear_cached_file() should not have returned non-nil")
+	for _, size := range []string{"100s", "200w"} {
+		d := &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec(size), Extension: ".png"}
+		st.Put(d, bytes.NewReader(contents))
 	}
+	st.PutMetadata(img.Hash, ImageMetadata{Hash: img.Hash.String()})
 
+	err = clear_cached(st, img.original())
+	if err != nil {
+		t.Errorf("clear_cached() should not have returned non-nil: %s", err)
+	}
+	entries, _ := st.Entries(img.Hash)
+	if len(entries) != 1 || !entries[0].Size.IsFull() {
+		t.Error("only the original should be left")
+	}
+	if _, err := st.GetMetadata(img.Hash); err != nil {
+		t.Error("clear_cached() should leave metadata alone")
+	}
 }
 
 // dummy out a StashableNode
@@ -65,7 +81,7 @@ type sdummy struct {
 	StashValue bool
 }
 
-func (s *sdummy) Stash(filename string, size_hints string) bool { return false }
+func (s *sdummy) Stash(ri *ImageSpecifier, size_hints string, st Store) bool { return false }
 func (s *sdummy) RetrieveImageInfo(ri *ImageSpecifier) (*ImageInfoResponse, error) {
 	return nil, nil
 }
@@ -80,7 +96,7 @@ func Test_RetrieveReplica(t *testing.T) {
 	cn := make([]NodeData, 0)
 	_, c := makeNewClusterData(cn)
 	s := SiteConfig{}
-	r := NewImageRebalancer("foo", ".jpg", hash, c, s, sl)
+	r := NewImageRebalancer(originalSpecifier(hash, ".jpg"), c, s, sl, NewMemoryStore())
 	result := r.retrieveReplica(&n, true)
 	if result != 0 {
 		t.Error("satisfied == true should mean no retrieval")
@@ -91,28 +107,42 @@ func Test_RetrieveReplica(t *testing.T) {
 	}
 }
 
-func Test_visitPreChecks(t *testing.T) {
-	sl := DummyLogger{}
-	cn := make([]NodeData, 0)
-	_, c := makeNewClusterData(cn)
-	done, err := visitPreChecks("full.jpg", fdummy{}, nil, c, sl)
-	if done {
-		t.Error(fmt.Sprintf("shouldn't have been any problems there: %s", err))
+func Test_isOriginal(t *testing.T) {
+	if !isOriginal("full.jpg", fdummy{}) {
+		t.Error("full.jpg is an original")
 	}
-	if err != nil {
-		t.Error(fmt.Sprintf("shouldn't have been any problems there: %s", err))
-	}
-	done, err = visitPreChecks("foo.jpg", fdummy{}, nil, c, sl)
-	if !done {
+	if isOriginal("foo.jpg", fdummy{}) {
 		t.Error("not 'full.jpg', should not allow")
 	}
-	done, err = visitPreChecks("full.jpg", fdummy{DirValue: true}, nil, c, sl)
-	if !done {
+	if isOriginal("full.jpg", fdummy{DirValue: true}) {
 		t.Error("claims to be a directory")
 	}
-	done, err = visitPreChecks("full.jpg", fdummy{}, nil, nil, sl)
-	if !done {
+	if isOriginal("full", fdummy{}) {
+		t.Error("no extension")
+	}
+}
+
+func Test_visit(t *testing.T) {
+	sl := DummyLogger{}
+	_, c := makeNewClusterData(make([]NodeData, 0))
+	st := NewMemoryStore()
+	if visit(originalSpecifier(nil, ".jpg"), nil, SiteConfig{}, st, sl) == nil {
 		t.Error("nil cluster")
 	}
 
+	img, err := ingestImage(st, bytes.NewReader(encodedTestImage("png", 4, 4)), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (a full visit sleeps afterwards, so only the early
+	// return for deleted images is checked here)
+	c.TombstoneKeys = []string{"sekrit"}
+	c.AddTombstone(c.NewTombstone(img.Hash.String(), time.Now()))
+	err = visit(img.original(), c, SiteConfig{}, st, sl)
+	if err != nil {
+		t.Errorf("shouldn't have been any problems there: %s", err)
+	}
+	if _, err := st.Stat(img.original()); err == nil {
+		t.Error("a tombstoned image should be removed")
+	}
 }
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"crypto/sha1"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"image"
@@ -11,8 +12,11 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,6 +29,14 @@ type Context struct {
 	Cfg     SiteConfig
 	Ch      SharedChannels
 	SL      Logger
+	Store   Store
+	// the upload directories underneath Store, for
+	// reporting on their health
+	Directories *MultiStore
+	// and the derivative budget on top of it
+	Derivatives *EvictingStore
+	// perceptual hashes of everything in Store
+	Similar *SimilarityIndex
 }
 
 type Page struct {
@@ -35,10 +47,16 @@ type Page struct {
 type ImageData struct {
 	Hash      string   `json:"hash"`
 	Length    int      `json:"length"`
+	Width     int      `json:"width"`
+	Height    int      `json:"height"`
 	Extension string   `json:"extension"`
 	FullUrl   string   `json:"full_url"`
 	Satisfied bool     `json:"satisfied"`
 	Nodes     []string `json:"nodes"`
+	// already in the cluster, so nothing was written or stashed
+	Existing bool `json:"existing"`
+	// near duplicates, if the upload asked to have them flagged
+	Similar []SimilarImage `json:"similar,omitempty"`
 }
 
 var jpeg_options = jpeg.Options{Quality: 90}
@@ -49,9 +67,17 @@ func setCacheHeaders(w http.ResponseWriter, extension string) http.ResponseWrite
 	return w
 }
 
+// for passing options along on a redirect
+func queryString(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return ""
+	}
+	return "?" + r.URL.RawQuery
+}
+
 func parsePathServeImage(w http.ResponseWriter, r *http.Request,
 	ctx Context) (*ImageSpecifier, bool) {
-	parts := strings.Split(r.URL.String(), "/")
+	parts := strings.Split(r.URL.Path, "/")
 	if (len(parts) < 5) || (parts[1] != "image") {
 		http.Error(w, "bad request", 404)
 		return nil, true
@@ -69,7 +95,7 @@ func parsePathServeImage(w http.ResponseWriter, r *http.Request,
 	s := resize.MakeSizeSpec(size)
 	if s.String() != size {
 		// force normalization of size spec
-		http.Redirect(w, r, "/image/"+ahash.String()+"/"+s.String()+"/"+parts[4], 301)
+		http.Redirect(w, r, "/image/"+ahash.String()+"/"+s.String()+"/"+parts[4]+queryString(r), 301)
 		return nil, true
 	}
 	filename := parts[4]
@@ -80,10 +106,29 @@ func parsePathServeImage(w http.ResponseWriter, r *http.Request,
 
 	if extension == ".jpeg" {
 		fixed_filename := strings.Replace(parts[4], ".jpeg", ".jpg", 1)
-		http.Redirect(w, r, "/image/"+ahash.String()+"/"+s.String()+"/"+fixed_filename, 301)
+		http.Redirect(w, r, "/image/"+ahash.String()+"/"+s.String()+"/"+fixed_filename+queryString(r), 301)
+		return nil, true
+	}
+	if extension == autoExtension {
+		// whatever we pick, caches need to know it depends on this
+		w.Header().Add("Vary", "Accept")
+		negotiated, ok := ctx.negotiateFormat(r, ahash, s)
+		if !ok {
+			http.Error(w, "not found", 404)
+			return nil, true
+		}
+		extension = negotiated
+	}
+	if _, ok := extmimes[strings.TrimPrefix(extension, ".")]; !ok {
+		http.Error(w, "unsupported format", 404)
 		return nil, true
 	}
-	ri := &ImageSpecifier{ahash, s, extension}
+	ri := &ImageSpecifier{Hash: ahash, Size: s, Extension: extension}
+	// ?static=true gets just the first frame of an animated gif
+	ri.Static = extension == ".gif" && r.FormValue("static") == "true"
+	if s.IsFull() {
+		ri = ctx.fullSizeIn(ri)
+	}
 	return ri, false
 }
 
@@ -101,7 +146,7 @@ func (ctx Context) serveFromCluster(ri *ImageSpecifier, w http.ResponseWriter) {
 }
 
 func (ctx Context) serveDirect(ri *ImageSpecifier, w http.ResponseWriter) bool {
-	contents, err := ioutil.ReadFile(ri.sizedPath(ctx.Cfg.UploadDirectory))
+	contents, err := readAll(ctx.Store, ri)
 	if err == nil {
 		// we've got it, so serve it directly
 		w = setCacheHeaders(w, ri.Extension)
@@ -116,6 +161,12 @@ func ServeImageHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 	if handled {
 		return
 	}
+	// groupcache has no way to evict, so deleted images
+	// have to be stopped before we ever ask it
+	if ctx.Cluster.Tombstoned(ri.Hash.String()) {
+		http.Error(w, "image has been deleted", 410)
+		return
+	}
 
 	var data []byte
 	err := ctx.Cluster.Imagecache.Get(nil, ri.String(),
@@ -137,16 +188,17 @@ func ServeImageHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 
 	// we do have the full-size, but not the scaled one
 	// so resize it, cache it, and serve it.
-	if !ctx.locallyWriteable() {
-		// but first, make sure we are writeable. If not,
-		// we need to let another node in the cluster handle it.
+	if !ctx.locallyWriteable() || !ctx.Cluster.GetMyself().CanMake(ri.Extension) {
+		// but first, make sure we are writeable (and can write
+		// this format). If not, we need to let another node in
+		// the cluster handle it.
 		ctx.serveScaledFromCluster(ri, w)
 		return
 	}
 
 	result := ctx.makeResizeJob(ri)
 	if !result.Success {
-		http.Error(w, "could not resize image", 500)
+		resizeFailed(w, result)
 		return
 	}
 	if result.Magick {
@@ -158,12 +210,23 @@ func ServeImageHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 	ctx.serveScaledByExtension(ri, w, *result.OutputImage)
 }
 
+// an original that's over the limits (which may have been
+// tightened since it was uploaded) is the client's problem,
+// not ours
+func resizeFailed(w http.ResponseWriter, result ResizeResponse) {
+	if ue, ok := result.Err.(uploadError); ok {
+		jsonError(w, ue.Message, ue.Status)
+		return
+	}
+	http.Error(w, "could not resize image", 500)
+}
+
 func (ctx Context) locallyWriteable() bool {
-	return ctx.Cluster.Myself.Writeable
+	return ctx.Cluster.GetMyself().Writeable
 }
 
 func (ctx Context) haveImageFullsizeLocally(ri *ImageSpecifier) bool {
-	_, err := ioutil.ReadFile(ri.fullSizePath(ctx.Cfg.UploadDirectory))
+	_, err := originalFor(ctx.Store, ri)
 	return err == nil
 }
 
@@ -181,38 +244,37 @@ func (ctx Context) serveScaledFromCluster(ri *ImageSpecifier, w http.ResponseWri
 
 func (ctx Context) makeResizeJob(ri *ImageSpecifier) ResizeResponse {
 	c := make(chan ResizeResponse)
-	ctx.Ch.ResizeQueue <- ResizeRequest{ri.fullSizePath(ctx.Cfg.UploadDirectory), ri.Extension, ri.Size.String(), c}
+	ctx.Ch.ResizeQueue <- ResizeRequest{ri, c}
 	result := <-c
 	return result
 }
 
 func (ctx Context) serveMagick(ri *ImageSpecifier, w http.ResponseWriter) {
-	img_contents, _ := ioutil.ReadFile(ri.sizedPath(ctx.Cfg.UploadDirectory))
+	img_contents, _ := readAll(ctx.Store, ri)
 	w = setCacheHeaders(w, ri.Extension)
 	w.Write(img_contents)
 }
 
 func (ctx Context) serveScaledByExtension(ri *ImageSpecifier, w http.ResponseWriter,
 	outputImage image.Image) {
-
-	wFile, err := os.OpenFile(ri.sizedPath(ctx.Cfg.UploadDirectory), os.O_CREATE|os.O_RDWR, 0644)
-	defer wFile.Close()
-	if err != nil {
-		// what do we do if we can't write?
-		// we still have the resized image, so we can serve the response
-		// we just can't cache it.
-	}
+	contents := encodeAndCache(ctx.Store, ri, outputImage, ctx.SL)
 	w = setCacheHeaders(w, ri.Extension)
-
-	serveType(wFile, outputImage, w, ctx, ri, extencoders[ri.Extension])
+	w.Write(contents)
 }
 
 type encfunc func(io.Writer, image.Image) error
 
-func serveType(wFile *os.File, outputImage image.Image, w http.ResponseWriter, ctx Context,
-	ri *ImageSpecifier, encFunc encfunc) {
-	encFunc(wFile, outputImage)
-	encFunc(w, outputImage)
+// encodes the image and stores it as the derivative. if we can't
+// store it, we still have the resized image, so we can serve the
+// response; we just can't cache it.
+func encodeAndCache(st Store, ri *ImageSpecifier, outputImage image.Image, sl Logger) []byte {
+	var buf bytes.Buffer
+	extencoders[ri.Extension](&buf, outputImage)
+	err := st.Put(ri, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		sl.Err(fmt.Sprintf("could not cache %s: %s", ri.String(), err.Error()))
+	}
+	return buf.Bytes()
 }
 
 var mimeexts = map[string]string{
@@ -221,10 +283,14 @@ var mimeexts = map[string]string{
 	"image/png":  "png",
 }
 
+// everything we can serve. webp and avif are only ever
+// derivatives, made (by imagemagick) from whatever the original is.
 var extmimes = map[string]string{
-	"jpg": "image/jpeg",
-	"gif": "image/gif",
-	"png": "image/png",
+	"jpg":  "image/jpeg",
+	"gif":  "image/gif",
+	"png":  "image/png",
+	"webp": "image/webp",
+	"avif": "image/avif",
 }
 
 func jpgencode(out io.Writer, in image.Image) error {
@@ -234,57 +300,35 @@ func jpgencode(out io.Writer, in image.Image) error {
 var extencoders = map[string]encfunc{
 	".jpg": jpgencode,
 	".png": png.Encode,
-	// image/gif doesn't include an Encode()
-	// so we'll use png for now.
-	// :(
-	".gif": png.Encode,
+	".gif": gifencode,
 }
 
 func AddHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 	if r.Method == "POST" {
+		// before anything reads the form
+		if err := ctx.limitBody(w, r); err != nil {
+			ctx.uploadFailed(w, err)
+			return
+		}
 		if ctx.Cfg.KeyRequired() {
 			if !ctx.Cfg.ValidKey(r.FormValue("key")) {
 				http.Error(w, "invalid upload key", 403)
 				return
 			}
 		}
-		i, fh, _ := r.FormFile("image")
-		defer i.Close()
-		h := sha1.New()
-		io.Copy(h, i)
-		ahash, err := HashFromString(fmt.Sprintf("%x", h.Sum(nil)), "")
+		i, fh, err := r.FormFile("image")
 		if err != nil {
-			http.Error(w, "bad hash", 500)
+			ctx.uploadFailed(w, bodyError(err, "no image uploaded"))
 			return
 		}
-		path := ctx.Cfg.UploadDirectory + ahash.AsPath()
-		os.MkdirAll(path, 0755)
-		mimetype := fh.Header.Get("Content-Type")
-		if mimetype == "" {
-			// they left off a mimetype, so default to jpg
-			mimetype = "image/jpeg"
-		}
-		ext := mimeexts[mimetype]
-		fullpath := path + "/full." + ext
-		f, _ := os.OpenFile(fullpath, os.O_CREATE|os.O_RDWR, 0644)
-		defer f.Close()
-		i.Seek(0, 0)
-		io.Copy(f, i)
-		size_hints := r.FormValue("size_hints")
-		// yes, the full-size for this image gets written to disk on
-		// this node even if it may not be one of the "right" ones
-		// for it to end up on. This isn't optimal, but is easy
-		// and we can just let the verify/balance worker clean it up
-		// at some point in the future.
-
-		// now stash it to other nodes in the cluster too
-		nodes := ctx.Cluster.Stash(ahash, fullpath, size_hints, ctx.Cfg.Replication, ctx.Cfg.MinReplication)
-		id := ImageData{
-			Hash:      ahash.String(),
-			Extension: ext,
-			FullUrl:   "/image/" + ahash.String() + "/full/image." + ext,
-			Satisfied: len(nodes) >= ctx.Cfg.MinReplication,
-			Nodes:     nodes,
+		defer i.Close()
+		// whatever the client claims in Content-Type, the format
+		// we store is the one the bytes say it is
+		id, err := ctx.upload(i, uploadMetadata(fh.Filename, r.FormValue("key")), r.FormValue("size_hints"),
+			r.FormValue("near_duplicates"), r.FormValue("key"))
+		if err != nil {
+			ctx.uploadFailed(w, err)
+			return
 		}
 		b, err := json.Marshal(id)
 		if err != nil {
@@ -301,11 +345,172 @@ func AddHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 	}
 }
 
+// like AddHandler, but the node downloads the image
+// itself from the url it is given
+func FetchHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	if r.Method != "POST" {
+		p := Page{
+			Title:      "fetch image",
+			RequireKey: ctx.Cfg.KeyRequired(),
+		}
+		t, _ := template.New("fetch").Parse(fetch_template)
+		t.Execute(w, &p)
+		return
+	}
+	if ctx.Cfg.KeyRequired() {
+		if !ctx.Cfg.ValidKey(r.FormValue("key")) {
+			http.Error(w, "invalid upload key", 403)
+			return
+		}
+	}
+	source := r.FormValue("url")
+	if source == "" {
+		http.Error(w, "no url specified", 400)
+		return
+	}
+	f, err := fetchImage(source, ctx.Cfg)
+	if err != nil {
+		ctx.uploadFailed(w, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	u, _ := url.Parse(source)
+	id, err := ctx.upload(f, uploadMetadata(path.Base(u.Path), r.FormValue("key")), r.FormValue("size_hints"),
+		r.FormValue("near_duplicates"), r.FormValue("key"))
+	if err != nil {
+		ctx.uploadFailed(w, err)
+		return
+	}
+	b, err := json.Marshal(id)
+	if err != nil {
+		ctx.SL.Err(err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// many images in one request, either as several "image" parts,
+// "archive" parts (zip, tar or tar.gz), or both. Responds with one
+// result per image; a bad image only fails its own entry.
+func BatchHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", 400)
+		return
+	}
+	// many images, so it gets more room than a single upload.
+	// each one is still held to that as it's ingested. This has
+	// to come before anything reads the form (like the key check)
+	if err := ctx.limitBodyTo(w, r, ctx.Cfg.MaxBatchBytes); err != nil {
+		ctx.uploadFailed(w, err)
+		return
+	}
+	if ctx.Cfg.KeyRequired() {
+		if !ctx.Cfg.ValidKey(r.FormValue("key")) {
+			http.Error(w, "invalid upload key", 403)
+			return
+		}
+	}
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		ctx.uploadFailed(w, bodyError(err, "expected a multipart upload"))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	size_hints, key := r.FormValue("size_hints"), r.FormValue("key")
+	near_duplicates := r.FormValue("near_duplicates")
+	results := make([]BatchResult, 0)
+	for _, fh := range r.MultipartForm.File["image"] {
+		results = append(results, ctx.batchUpload(fh, size_hints, near_duplicates, key))
+	}
+	for _, fh := range r.MultipartForm.File["archive"] {
+		results = append(results, ctx.batchArchive(fh, size_hints, near_duplicates, key)...)
+	}
+	b, err := json.Marshal(results)
+	if err != nil {
+		ctx.SL.Err(err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// takes a freshly ingested original, stashes it out to the
+// rest of the cluster, and describes where it ended up
+func (ctx Context) replicate(img *ingestedImage, size_hints string) ImageData {
+	// yes, the full-size for this image gets written to disk on
+	// this node even if it may not be one of the "right" ones
+	// for it to end up on. This isn't optimal, but is easy
+	// and we can just let the verify/balance worker clean it up
+	// at some point in the future.
+
+	// now stash it to other nodes in the cluster too
+	nodes := ctx.Cluster.Stash(img.original(), ctx.Store, size_hints, ctx.Cfg.Replication, ctx.Cfg.MinReplication)
+	return img.imageData(nodes, ctx.Cfg.MinReplication)
+}
+
+func (img *ingestedImage) imageData(nodes []string, min_replication int) ImageData {
+	ahash, ext := img.Hash, img.Extension
+	return ImageData{
+		Hash:      ahash.String(),
+		Length:    int(img.Length),
+		Width:     img.Config.Width,
+		Height:    img.Config.Height,
+		Extension: ext,
+		FullUrl:   "/image/" + ahash.String() + "/full/image." + ext,
+		Satisfied: len(nodes) >= min_replication,
+		Nodes:     nodes,
+	}
+}
+
+// reports a failed ingest back to the client, as JSON, so
+// it can tell what went wrong (like which limit it hit)
+func (ctx Context) uploadFailed(w http.ResponseWriter, err error) {
+	if ue, ok := err.(uploadError); ok {
+		jsonError(w, ue.Message, ue.Status)
+		return
+	}
+	ctx.SL.Err(fmt.Sprintf("could not save image: %s", err.Error()))
+	jsonError(w, "could not save image", 500)
+}
+
+// turns away request bodies bigger than any upload we'd accept. a
+// little slack is left for the rest of a multipart form; the image
+// itself is held to the exact limit at ingest.
+// The error, if there is one, is for the caller to report.
+func (ctx Context) limitBody(w http.ResponseWriter, r *http.Request) error {
+	return ctx.limitBodyTo(w, r, ctx.Cfg.MaxUploadBytes)
+}
+
+func (ctx Context) limitBodyTo(w http.ResponseWriter, r *http.Request, limit int64) error {
+	if limit < 1 {
+		return nil
+	}
+	if r.ContentLength > limit+(1<<20) {
+		return ImageLimits{MaxBytes: limit}.checkLength(r.ContentLength)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit+(1<<20))
+	return nil
+}
+
+// a read of the request body failing because it went over
+// limitBody's limit should be reported as such
+func bodyError(err error, message string) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return uploadError{413, fmt.Sprintf("upload is larger than the limit of %d bytes", mbe.Limit)}
+	}
+	return uploadError{400, message}
+}
+
 type StatusPage struct {
-	Title     string
-	Config    SiteConfig
-	Cluster   *Cluster
-	Neighbors []NodeData
+	Title       string
+	Config      SiteConfig
+	Cluster     *Cluster
+	Myself      NodeData
+	Neighbors   []NodeData
+	Directories []DirectoryStatus
+	Derivatives *EvictionStats
 }
 
 func StatusHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
@@ -313,14 +518,22 @@ func StatusHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 		Title:     "Status",
 		Config:    ctx.Cfg,
 		Cluster:   ctx.Cluster,
+		Myself:    ctx.Cluster.GetMyself(),
 		Neighbors: ctx.Cluster.GetNeighbors(),
 	}
+	if ctx.Directories != nil {
+		p.Directories = ctx.Directories.Status()
+	}
+	if ctx.Derivatives != nil {
+		stats := ctx.Derivatives.Stats()
+		p.Derivatives = &stats
+	}
 	t, _ := template.New("status").Parse(status_template)
 	t.Execute(w, p)
 }
 
 func ConfigHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
-	b, err := json.Marshal(ctx.Cluster.Myself)
+	b, err := json.Marshal(ctx.Cluster.GetMyself())
 	if err != nil {
 		ctx.SL.Err(err.Error())
 	}
@@ -329,7 +542,7 @@ func ConfigHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 }
 
 func StashHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
-	n := ctx.Cluster.Myself
+	n := ctx.Cluster.GetMyself()
 	if r.Method != "POST" {
 		http.Error(w, "POST only", 400)
 		return
@@ -338,29 +551,28 @@ func StashHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 		http.Error(w, "non-writeable node", 400)
 		return
 	}
+	if n.NearlyFull(ctx.Cfg.HighWaterMark) {
+		http.Error(w, "node is nearly full", 507)
+		return
+	}
 
-	i, fh, err := r.FormFile("image")
+	i, _, err := r.FormFile("image")
 	if err != nil {
 		http.Error(w, "no image uploaded", 400)
 		return
 	}
 	defer i.Close()
-	h := sha1.New()
-	io.Copy(h, i)
-	ahash, err := HashFromString(fmt.Sprintf("%x", h.Sum(nil)), "")
+	// the original upload's metadata travels with each replica
+	var meta ImageMetadata
+	if m, err := parseMetadata([]byte(r.FormValue("metadata"))); err == nil {
+		meta = *m
+	}
+	img, err := ctx.ingest(i, r.FormValue("hash"), meta)
 	if err != nil {
-		http.Error(w, "bad hash", 404)
+		ctx.uploadFailed(w, err)
 		return
 	}
-
-	path := ctx.Cfg.UploadDirectory + ahash.AsPath()
-	os.MkdirAll(path, 0755)
-	ext := filepath.Ext(fh.Filename)
-	fullpath := path + "/full" + ext
-	f, _ := os.OpenFile(fullpath, os.O_CREATE|os.O_RDWR, 0644)
-	defer f.Close()
-	i.Seek(0, 0)
-	io.Copy(f, i)
+	ahash, ext := img.Hash, "."+img.Extension
 	fmt.Fprint(w, "ok")
 	// do any eager resizing in the background
 	size_hints := r.FormValue("size_hints")
@@ -370,11 +582,12 @@ func StashHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 			if size == "" {
 				continue
 			}
-			c := make(chan ResizeResponse)
-			ctx.Ch.ResizeQueue <- ResizeRequest{fullpath, ext, size, c}
-			result := <-c
+			ri := &ImageSpecifier{Hash: ahash, Size: resize.MakeSizeSpec(size), Extension: ext}
+			result := ctx.makeResizeJob(ri)
 			if !result.Success {
 				ctx.SL.Err("could not pre-resize")
+			} else if !result.Magick {
+				encodeAndCache(ctx.Store, ri, *result.OutputImage, ctx.SL)
 			}
 		}
 	}()
@@ -392,23 +605,25 @@ func RetrieveInfoHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 		http.Error(w, "bad hash", 404)
 		return
 	}
+	if ctx.Cluster.Tombstoned(ahash.String()) {
+		http.Error(w, "image has been deleted", 404)
+		return
+	}
 	extension := parts[4]
 	var local = true
-	baseDir := ctx.Cfg.UploadDirectory + ahash.AsPath()
-	path := baseDir + "/full" + "." + extension
-	_, err = os.Open(path)
+	ri := &ImageSpecifier{Hash: ahash, Size: resize.MakeSizeSpec(parts[3]), Extension: "." + extension}
+	_, err = originalFor(ctx.Store, ri)
 	if err != nil {
 		local = false
 	}
 
 	// if we aren't writeable, we can't resize locally
 	// let them know this as early as possible
-	size := parts[3]
-	n := ctx.Cluster.Myself
-	if size != "full" && !n.Writeable {
+	n := ctx.Cluster.GetMyself()
+	if !ri.Size.IsFull() && (!n.Writeable || !n.CanMake(ri.Extension)) {
 		// anything other than full-size, we can't do
 		// if we don't have it already
-		_, err = os.Open(baseDir + "/" + size + "." + extension)
+		_, err = ctx.Store.Stat(ri)
 		if err != nil {
 			local = false
 		}
@@ -425,7 +640,7 @@ func RetrieveInfoHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 func RetrieveHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 
 	// request will look like /retrieve/$hash/$size/$ext/
-	parts := strings.Split(r.URL.String(), "/")
+	parts := strings.Split(r.URL.Path, "/")
 	if (len(parts) != 6) || (parts[1] != "retrieve") {
 		http.Error(w, "bad request", 404)
 		return
@@ -435,21 +650,22 @@ func RetrieveHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 		http.Error(w, "bad hash", 404)
 		return
 	}
-	size := parts[3]
+	if ctx.Cluster.Tombstoned(ahash.String()) {
+		http.Error(w, "image has been deleted", 404)
+		return
+	}
 	extension := parts[4]
+	ri := &ImageSpecifier{Hash: ahash, Size: resize.MakeSizeSpec(parts[3]), Extension: "." + extension}
+	ri.Static = extension == "gif" && r.FormValue("static") == "true"
 
-	baseDir := ctx.Cfg.UploadDirectory + ahash.AsPath()
-	path := baseDir + "/full" + "." + extension
-	sizedPath := baseDir + "/" + size + "." + extension
-
-	contents, err := ioutil.ReadFile(sizedPath)
+	contents, err := readAll(ctx.Store, ri)
 	if err == nil {
 		// we've got it, so serve it directly
 		w.Header().Set("Content-Type", extmimes[extension])
 		w.Write(contents)
 		return
 	}
-	_, err = ioutil.ReadFile(path)
+	_, err = originalFor(ctx.Store, ri)
 	if err != nil {
 		// we don't have the full-size on this node either
 		http.Error(w, "not found (retrieveHandler)", 404)
@@ -460,58 +676,240 @@ func RetrieveHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 
 	// if we aren't writeable, we can't resize locally though.
 	// 404 and let another node handle it
-	n := ctx.Cluster.Myself
-	if !n.Writeable {
+	n := ctx.Cluster.GetMyself()
+	if !n.Writeable || !n.CanMake(ri.Extension) {
 		http.Error(w, "could not resize image", 404)
 		return
 	}
 
 	c := make(chan ResizeResponse)
-	ctx.Ch.ResizeQueue <- ResizeRequest{path, "." + extension, size, c}
+	ctx.Ch.ResizeQueue <- ResizeRequest{ri, c}
 	result := <-c
 	if !result.Success {
-		http.Error(w, "could not resize image", 500)
+		resizeFailed(w, result)
 		return
 	}
 	if result.Magick {
 		// imagemagick did the resize, so we just spit out
 		// the sized file
 		w.Header().Set("Content-Type", extmimes[extension])
-		img_contents, _ := ioutil.ReadFile(sizedPath)
+		img_contents, _ := readAll(ctx.Store, ri)
 		w.Write(img_contents)
 		return
 	}
 	outputImage := *result.OutputImage
+	contents = encodeAndCache(ctx.Store, ri, outputImage, ctx.SL)
+	w.Header().Set("Content-Type", extmimes[extension])
+	w.Write(contents)
+}
 
-	wFile, err := os.OpenFile(sizedPath, os.O_CREATE|os.O_RDWR, 0644)
+// metadata for an original, as JSON
+// request will look like /info/$hash/
+// with ?local=true, only answers from this node's own copy
+func InfoHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	parts := strings.Split(r.URL.Path, "/")
+	if (len(parts) != 4) || (parts[1] != "info") {
+		jsonError(w, "bad request", 404)
+		return
+	}
+	ahash, err := HashFromString(parts[2], "")
 	if err != nil {
-		// what do we do if we can't write?
-		// we still have the resized image, so we can serve the response
-		// we just can't cache it.
+		jsonError(w, "invalid hash", 404)
+		return
 	}
-	defer wFile.Close()
-	w.Header().Set("Content-Type", extmimes[extension])
-	if extension == "jpg" {
-		jpeg.Encode(wFile, outputImage, &jpeg_options)
-		jpeg.Encode(w, outputImage, &jpeg_options)
+	if ctx.Cluster.Tombstoned(ahash.String()) {
+		jsonError(w, "image has been deleted", 410)
+		return
+	}
+	if m, err := ctx.Store.GetMetadata(ahash); err == nil {
+		jsonResponse(w, m, 200)
+		return
+	}
+	if r.FormValue("local") == "" {
+		for _, n := range ctx.Cluster.ReadOrder(ahash.String()) {
+			if n.UUID == ctx.Cluster.Myself.UUID {
+				continue
+			}
+			m, err := n.RetrieveMetadata(ahash)
+			if err == nil {
+				jsonResponse(w, m, 200)
+				return
+			}
+		}
+	}
+	jsonError(w, "not found", 404)
+}
+
+// the hashes stored here (or, with cluster=true, anywhere in the
+// cluster), a page at a time
+// request will look like /list/?after=$hash&limit=$n&cluster=true
+func ListHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	key := r.FormValue("key")
+	if ctx.Cfg.KeyRequired() && !ctx.Cfg.ValidKey(key) {
+		jsonError(w, "invalid upload key", 403)
+		return
+	}
+	after := r.FormValue("after")
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	local, err := listLocalImages(ctx.Store, after, limit, ctx.Cluster)
+	if err != nil {
+		ctx.SL.Err(fmt.Sprintf("could not list images: %s", err.Error()))
+		jsonError(w, "could not list images", 500)
+		return
+	}
+	if r.FormValue("cluster") == "" {
+		jsonResponse(w, local, 200)
 		return
 	}
-	if extension == "gif" {
-		// image/gif doesn't include an Encode()
-		// so we'll use png for now.
-		// :(
-		png.Encode(wFile, outputImage)
-		png.Encode(w, outputImage)
+
+	listings := []*ImageListing{local}
+	nodes := []string{ctx.Cluster.Myself.Nickname}
+	var unreachable []string
+	for _, n := range ctx.Cluster.GetNeighbors() {
+		l, err := n.ListImages(after, limit, key)
+		if err != nil {
+			ctx.SL.Warning(fmt.Sprintf("could not get listing from %s: %s", n.Nickname, err.Error()))
+			unreachable = append(unreachable, n.Nickname)
+			continue
+		}
+		listings = append(listings, l)
+		nodes = append(nodes, n.Nickname)
+	}
+	merged := mergeListings(listings, nodes, limit)
+	merged.Unreachable = unreachable
+	jsonResponse(w, merged, 200)
+}
+
+// images that look like the given one, within a Hamming distance
+// of their perceptual hashes.
+// request will look like /similar/$hash/?distance=N
+// with cluster=1 to ask every node, not just this one
+func SimilarHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	key := r.FormValue("key")
+	if ctx.Cfg.KeyRequired() && !ctx.Cfg.ValidKey(key) {
+		jsonError(w, "invalid upload key", 403)
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 || parts[1] != "similar" {
+		jsonError(w, "bad request", 404)
+		return
+	}
+	ahash, err := HashFromString(parts[2], "")
+	if err != nil {
+		jsonError(w, "invalid hash", 404)
 		return
 	}
-	if extension == "png" {
-		png.Encode(wFile, outputImage)
-		png.Encode(w, outputImage)
+	distance, err := strconv.Atoi(r.FormValue("distance"))
+	if err != nil || distance < 0 {
+		distance = ctx.Cfg.NearDuplicateDistance
+	}
+	if distance > 64 {
+		distance = 64
+	}
+	// other nodes asking on behalf of someone tell us what
+	// to look for, since we might not have the image at all
+	var phash uint64
+	var ok bool
+	if r.FormValue("phash") != "" {
+		phash, err = parsePerceptualHash(r.FormValue("phash"))
+		ok = err == nil
+	} else {
+		phash, ok = ctx.perceptualHash(ahash)
+	}
+	if !ok {
+		jsonError(w, "don't know what that image looks like", 404)
 		return
 	}
+	var neighbors []NodeData
+	if r.FormValue("cluster") != "" && r.FormValue("phash") == "" {
+		neighbors = ctx.Cluster.GetNeighbors()
+	}
+	jsonResponse(w, ctx.similarImages(ahash.String(), phash, distance, neighbors, key), 200)
+}
+
+// from our own index if we have the image,
+// otherwise from another node's metadata
+func (ctx Context) perceptualHash(hash *Hash) (uint64, bool) {
+	if phash, ok := ctx.Similar.Lookup(hash.String()); ok {
+		return phash, true
+	}
+	for _, n := range ctx.Cluster.ReadOrder(hash.String()) {
+		if n.UUID == "" || n.UUID == ctx.Cluster.Myself.UUID {
+			continue
+		}
+		m, err := n.RetrieveMetadata(hash)
+		if err != nil {
+			continue
+		}
+		if phash, err := parsePerceptualHash(m.PerceptualHash); err == nil {
+			return phash, true
+		}
+	}
+	return 0, false
+}
+
+// another node telling us that an image has been deleted
+// request will look like /purge/$hash/
+func PurgeHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", 400)
+		return
+	}
+	// deletion is destructive enough that it is never open to all
+	if !ctx.Cfg.KeyRequired() || !ctx.Cfg.ValidKey(r.FormValue("key")) {
+		http.Error(w, "invalid upload key", 403)
+		return
+	}
+	parts := strings.Split(r.URL.String(), "/")
+	if (len(parts) != 4) || (parts[1] != "purge") {
+		http.Error(w, "bad request", 404)
+		return
+	}
+	ahash, err := HashFromString(parts[2], "")
+	if err != nil {
+		http.Error(w, "bad hash", 404)
+		return
+	}
+	deleted, err := time.Parse(time.RFC3339Nano, r.FormValue("deleted"))
+	if err != nil {
+		deleted = time.Now()
+	}
+	// the key was checked above, so this is as good as
+	// a deletion here
+	err = ctx.purge(ctx.Cluster.NewTombstone(ahash.String(), deleted))
+	if err != nil {
+		http.Error(w, "could not delete local copy", 500)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// records the tombstone and drops our copy of the image
+func (ctx Context) purge(t Tombstone) error {
+	ahash, err := HashFromString(t.Hash, "")
+	if err != nil {
+		return err
+	}
+	if ctx.Cluster.AddTombstone(t) {
+		ctx.SL.Info(fmt.Sprintf("deleting %s", t.Hash))
+	}
+	err = ctx.Store.DeleteAll(ahash)
+	if err != nil {
+		ctx.SL.Err(fmt.Sprintf("could not delete %s: %s", t.Hash, err.Error()))
+	}
+	return err
 }
 
 func AnnounceHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
+	// when we last heard from them, before this
+	var lastSeen time.Time
 	if r.Method == "POST" {
 		// another node is announcing themselves to us
 		// if they are already in the Neighbors list, update as needed
@@ -529,6 +927,9 @@ func AnnounceHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 			if r.FormValue("writeable") != "" {
 				neighbor.Writeable = r.FormValue("writeable") == "true"
 			}
+			neighbor.FreeBytes, neighbor.TotalBytes = announcedCapacity(r)
+			neighbor.OutputFormats = announcedFormats(r)
+			lastSeen = neighbor.LastSeen
 			neighbor.LastSeen = time.Now()
 			ctx.Cluster.UpdateNeighbor(*neighbor)
 			ctx.SL.Info("updated existing neighbor")
@@ -550,17 +951,24 @@ func AnnounceHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 			} else {
 				nd.Writeable = false
 			}
+			nd.FreeBytes, nd.TotalBytes = announcedCapacity(r)
+			nd.OutputFormats = announcedFormats(r)
 			nd.LastSeen = time.Now()
 			ctx.Cluster.AddNeighbor(nd)
 		}
 	}
+	me := ctx.Cluster.GetMyself()
 	ar := AnnounceResponse{
-		Nickname:  ctx.Cluster.Myself.Nickname,
-		UUID:      ctx.Cluster.Myself.UUID,
-		Location:  ctx.Cluster.Myself.Location,
-		Writeable: ctx.Cluster.Myself.Writeable,
-		BaseUrl:   ctx.Cluster.Myself.BaseUrl,
-		Neighbors: ctx.Cluster.GetNeighbors(),
+		Nickname:      me.Nickname,
+		UUID:          me.UUID,
+		Location:      me.Location,
+		Writeable:     me.Writeable,
+		BaseUrl:       me.BaseUrl,
+		FreeBytes:     me.FreeBytes,
+		TotalBytes:    me.TotalBytes,
+		OutputFormats: me.OutputFormats,
+		Neighbors:     ctx.Cluster.GetNeighbors(),
+		Tombstones:    ctx.tombstonesFor(lastSeen),
 	}
 	b, err := json.Marshal(ar)
 	if err != nil {
@@ -569,6 +977,33 @@ func AnnounceHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 	w.Write(b)
 }
 
+// normally just the deletions from the last TombstoneGossipDays.
+// A node that's new to us, or that we haven't heard from in
+// longer than that, could have missed older ones, so it gets
+// the lot to catch up with.
+func (ctx Context) tombstonesFor(lastSeen time.Time) []Tombstone {
+	since := time.Now().Add(-time.Duration(ctx.Cfg.TombstoneGossipDays) * 24 * time.Hour)
+	if lastSeen.Before(since) {
+		return ctx.Cluster.GetTombstones()
+	}
+	return ctx.Cluster.TombstonesSince(since)
+}
+
+// older nodes don't send these, which leaves them at zero
+// (ie, unknown)
+func announcedCapacity(r *http.Request) (uint64, uint64) {
+	free, _ := strconv.ParseUint(r.FormValue("free_bytes"), 10, 64)
+	total, _ := strconv.ParseUint(r.FormValue("total_bytes"), 10, 64)
+	return free, total
+}
+
+func announcedFormats(r *http.Request) []string {
+	if r.FormValue("output_formats") == "" {
+		return nil
+	}
+	return strings.Split(r.FormValue("output_formats"), ",")
+}
+
 func JoinHandler(w http.ResponseWriter, r *http.Request, ctx Context) {
 	if r.Method == "POST" {
 		if r.FormValue("url") == "" {
@@ -647,6 +1082,11 @@ const add_template = `
 {{end}}
 <input type="file" name="image" /><br />
 initial sizes to pre-create: <input type="text" name="size_hints" /><br />
+near duplicates: <select name="near_duplicates">
+<option value="">allow</option>
+<option value="flag">flag</option>
+<option value="reject">reject</option>
+</select><br />
 <input type="submit" value="upload image" />
 </form>
 
@@ -654,6 +1094,33 @@ initial sizes to pre-create: <input type="text" name="size_hints" /><br />
 </html>
 `
 
+const fetch_template = `
+<html>
+<head>
+<title>{{.Title}}</title>
+</head>
+
+<body>
+<h1>{{.Title}}</h1>
+
+<form action="." method="post">
+{{if .RequireKey}}
+<p>Upload key is required: <input type="text" name="key" /></p>
+{{end}}
+<input type="text" name="url" placeholder="Image URL" size="128" /><br />
+initial sizes to pre-create: <input type="text" name="size_hints" /><br />
+near duplicates: <select name="near_duplicates">
+<option value="">allow</option>
+<option value="flag">flag</option>
+<option value="reject">reject</option>
+</select><br />
+<input type="submit" value="fetch image" />
+</form>
+
+</body>
+</html>
+`
+
 const status_template = `
 <html>
 <head>
@@ -671,19 +1138,57 @@ const status_template = `
 	<tr><th>MinReplication</th><td>{{ .Config.MinReplication }}</td></tr>
 	<tr><th>MaxReplication</th><td>{{ .Config.MaxReplication }}</td></tr>
 	<tr><th># Resize Workers</th><td>{{ .Config.NumResizeWorkers }}</td></tr>
+	<tr><th>Resize Engine</th><td>{{ .Config.ResizeEngine }}</td></tr>
+	<tr><th>Output Formats</th><td>{{ range .Myself.OutputFormats }}{{ . }} {{ end }}</td></tr>
 	<tr><th>Gossip sleep duration</th><td>{{ .Config.GossiperSleep }}</td></tr>
+	<tr><th>High water mark</th><td>{{ .Config.HighWaterMark }}</td></tr>
 </table>
 
 <h2>This Node</h2>
 
 <table>
-	<tr><th>Nickname</th><td>{{ .Cluster.Myself.Nickname }}</td></tr>
-	<tr><th>UUID</th><td>{{ .Cluster.Myself.UUID }}</td></tr>
-	<tr><th>Location</th><td>{{ .Cluster.Myself.Location }}</td></tr>
-	<tr><th>Writeable</th><td>{{ .Cluster.Myself.Writeable }}</td></tr>
-	<tr><th>Base URL</th><td>{{ .Cluster.Myself.BaseUrl }}</td></tr>
+	<tr><th>Nickname</th><td>{{ .Myself.Nickname }}</td></tr>
+	<tr><th>UUID</th><td>{{ .Myself.UUID }}</td></tr>
+	<tr><th>Location</th><td>{{ .Myself.Location }}</td></tr>
+	<tr><th>Writeable</th><td>{{ .Myself.Writeable }}</td></tr>
+	<tr><th>Base URL</th><td>{{ .Myself.BaseUrl }}</td></tr>
+	<tr><th>Capacity</th><td>{{ .Myself.CapacityString }}</td></tr>
 </table>
 
+<h2>Upload Directories</h2>
+
+<table>
+	<tr>
+		<th>Path</th>
+		<th>Healthy</th>
+		<th>LastChecked</th>
+		<th>LastError</th>
+	</tr>
+
+{{ range .Directories }}
+
+	<tr>
+		<th>{{ .Path }}</th>
+		<td>{{ .Healthy }}</td>
+		<td>{{ .LastChecked }}</td>
+		<td>{{ .LastError }}</td>
+	</tr>
+
+{{ end }}
+
+</table>
+
+{{ with .Derivatives }}
+<h2>Derivatives</h2>
+
+<table>
+	<tr><th>Stored</th><td>{{ .Derivatives }} ({{ .BytesString }})</td></tr>
+	<tr><th>Budget</th><td>{{ .BudgetString }}</td></tr>
+	<tr><th>Evicted</th><td>{{ .Evictions }} ({{ .EvictedString }})</td></tr>
+	<tr><th>Last eviction</th><td>{{ if .LastEviction.IsZero }}never{{ else }}{{ .LastEviction }}{{ end }}</td></tr>
+</table>
+{{ end }}
+
 <h2>Neighbors</h2>
 
 <table>
@@ -693,6 +1198,7 @@ const status_template = `
 		<th>BaseUrl</th>
 		<th>Location</th>
 		<th>Writeable</th>
+		<th>Capacity</th>
 		<th>LastSeen</th>
 		<th>LastFailed</th>
 	</tr>
@@ -705,6 +1211,7 @@ const status_template = `
 		<td>{{ .BaseUrl }}</td>
 		<td>{{ .Location }}</td>
 		<td>{{ .Writeable }}</td>
+		<td>{{ .CapacityString }}</td>
 		<td>{{ .LastSeen }}</td>
 		<td>{{ .LastFailed }}</td>
 	</tr>
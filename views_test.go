@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
 	_ "fmt"
+	"github.com/thraxil/resize"
+	"image/png"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -33,3 +39,158 @@ func Test_hashStringToPath(t *testing.T) {
 	// 	t.Error("can't round-trip")
 	// }
 }
+
+func Test_StatusHandler(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	ctx.Directories = NewMultiStore(ctx.Cfg.UploadDirectories, DummyLogger{})
+	ctx.Derivatives = NewEvictingStore(ctx.Store, 1<<20, DummyLogger{})
+	ctx.Cluster.SetCapacity(50, 100)
+
+	w := httptest.NewRecorder()
+	StatusHandler(w, httptest.NewRequest("GET", "/status/", nil), ctx)
+	body := w.Body.String()
+	for _, s := range []string{"50 B free of 100 B", ctx.Cfg.UploadDirectory, "1.0 MiB", "never"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("status page is missing %q", s)
+		}
+	}
+}
+
+func Test_ServeImageHandlerResizes(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	ctx.Cfg.Writeable = true
+	ctx.Ch = SharedChannels{ResizeQueue: make(chan ResizeRequest)}
+	go ResizeWorker(ctx.Ch.ResizeQueue, DummyLogger{}, &ctx.Cfg, ctx.Store)
+	defer close(ctx.Ch.ResizeQueue)
+
+	img, err := ctx.ingest(bytes.NewReader(encodedTestImage("png", 30, 20)), "", ImageMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/image/"+img.Hash.String()+"/10w/image.png", nil)
+	ServeImageHandler(w, r, ctx)
+	if w.Code != 200 {
+		t.Fatalf("resize failed: %d %s", w.Code, w.Body.String())
+	}
+	cfg, err := png.DecodeConfig(w.Body)
+	if err != nil || cfg.Width != 10 || cfg.Height != 6 {
+		t.Error("didn't get the resized image back")
+	}
+	if _, err := ctx.Store.Stat(&ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("10w"), Extension: ".png"}); err != nil {
+		t.Error("resized image should have been stored")
+	}
+}
+
+// limits tightened after the original went in
+func Test_ServeImageHandlerOverLimits(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	ctx.Cfg.Writeable = true
+	ctx.Ch = SharedChannels{ResizeQueue: make(chan ResizeRequest)}
+	go ResizeWorker(ctx.Ch.ResizeQueue, DummyLogger{}, &ctx.Cfg, ctx.Store)
+	defer close(ctx.Ch.ResizeQueue)
+
+	img, err := ctx.ingest(bytes.NewReader(encodedTestImage("png", 30, 20)), "", ImageMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Cfg.MaxImageWidth = 20
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/image/"+img.Hash.String()+"/10w/image.png", nil)
+	ServeImageHandler(w, r, ctx)
+	if w.Code != 413 {
+		t.Errorf("resizing an image over the limits should be a 413, not %d", w.Code)
+	}
+	if msg := apiErrorMessage(t, w); !strings.Contains(msg, "limit") {
+		t.Errorf("should say what the limit is: %q", msg)
+	}
+}
+
+// /add/ answers in JSON, and so do its errors
+func Test_AddHandlerErrors(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	ctx.Cfg.MaxUploadBytes = 1
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("image", "image.png")
+	fw.Write(encodedTestImage("png", 30, 20))
+	mw.WriteField("key", "sekrit")
+	mw.Close()
+	r := httptest.NewRequest("POST", "/add/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	AddHandler(w, r, ctx)
+	if w.Code != 413 {
+		t.Errorf("should have been too big: %d", w.Code)
+	}
+	if msg := apiErrorMessage(t, w); !strings.Contains(msg, "limit") {
+		t.Errorf("should say what the limit is: %q", msg)
+	}
+}
+
+func Test_ServeImageHandlerFormats(t *testing.T) {
+	ctx, cleanup := apiTestContext(t)
+	defer cleanup()
+	convert, cleanupConvert := fakeConvert(t, `cp "$input" "$last"`)
+	defer cleanupConvert()
+	ctx.Cfg.Writeable = true
+	ctx.Cfg.ImageMagickConvertPath = convert
+	ctx.Cluster.Myself.OutputFormats = []string{"gif", "jpg", "png", "webp"}
+	ctx.Ch = SharedChannels{ResizeQueue: make(chan ResizeRequest)}
+	go ResizeWorker(ctx.Ch.ResizeQueue, DummyLogger{}, &ctx.Cfg, ctx.Store)
+	defer close(ctx.Ch.ResizeQueue)
+
+	img, err := ctx.ingest(bytes.NewReader(encodedTestImage("jpg", 30, 20)), "", ImageMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ServeImageHandler(w, httptest.NewRequest("GET", "/image/"+img.Hash.String()+path, nil), ctx)
+		return w
+	}
+	w := get("/10w/image.webp")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/webp" {
+		t.Fatalf("webp failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := ctx.Store.Stat(&ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("10w"), Extension: ".webp"}); err != nil {
+		t.Error("webp should have been stored like any other size")
+	}
+	// convert here can't make avif
+	for _, path := range []string{"/10w/image.bmp", "/10w/image.avif"} {
+		if w := get(path); w.Code != 404 {
+			t.Errorf("%s should be a 404, not %d", path, w.Code)
+		}
+	}
+	// any format can be made from any original, at any size
+	w = get("/10w/image.png")
+	if cfg, err := png.DecodeConfig(w.Body); err != nil || cfg.Width != 10 || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("should have converted the jpg to png: %d", w.Code)
+	}
+	w = get("/full/image.png")
+	if cfg, err := png.DecodeConfig(w.Body); err != nil || cfg.Width != 30 || cfg.Height != 20 || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("should have converted the jpg to a full size png: %d", w.Code)
+	}
+	// which is stored as a derivative, not a second original
+	if _, ok := findOriginal(ctx.Store, img.Hash); !ok {
+		t.Fatal("lost the original")
+	}
+	if orig, _ := findOriginal(ctx.Store, img.Hash); orig.Extension != ".jpg" {
+		t.Errorf("the png was stored as an original: %s", orig)
+	}
+	if _, err := ctx.Store.Stat(&ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("30x30"), Extension: ".png"}); err != nil {
+		t.Error("the png should have been stored at the original's size")
+	}
+	if w := get("/full/image.webp"); w.Code != 200 || w.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("full size webp failed: %d", w.Code)
+	}
+	// the original itself is still served as it is
+	if w := get("/full/image.jpg"); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), encodedTestImage("jpg", 30, 20)) {
+		t.Errorf("original should be served untouched: %d", w.Code)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/thraxil/resize"
 	"image"
@@ -8,22 +11,28 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Image is the derivative we want; the original
+// it gets made from is the full size of it
 type ResizeRequest struct {
-	Path      string
-	Extension string
-	Size      string
-	Response  chan ResizeResponse
+	Image    *ImageSpecifier
+	Response chan ResizeResponse
 }
 
 type ResizeResponse struct {
 	OutputImage *image.Image
 	Success     bool
 	Magick      bool
+	// why it failed, if it did
+	Err error
 }
 
 var decoders = map[string](func(io.Reader) (image.Image, error)){
@@ -32,61 +41,267 @@ var decoders = map[string](func(io.Reader) (image.Image, error)){
 	"png": png.Decode,
 }
 
-func ResizeWorker(requests chan ResizeRequest, sl Logger, s *SiteConfig) {
+// which does the resizing. Whichever is preferred,
+// the other gets a go if it fails.
+const (
+	resizeEngineNative      = "native"
+	resizeEngineImageMagick = "imagemagick"
+)
+
+func knownResizeEngine(engine string) bool {
+	return engine == resizeEngineNative || engine == resizeEngineImageMagick
+}
+
+func resizeEngines(preferred string) []string {
+	if preferred == resizeEngineImageMagick {
+		return []string{resizeEngineImageMagick, resizeEngineNative}
+	}
+	return []string{resizeEngineNative, resizeEngineImageMagick}
+}
+
+func ResizeWorker(requests chan ResizeRequest, sl Logger, s *SiteConfig, st Store) {
 	for req := range requests {
 		if !s.Writeable {
 			// node is not writeable, so we should never handle a resize
-			req.Response <- ResizeResponse{nil, false, false}
+			req.Response <- ResizeResponse{nil, false, false, errors.New("node is not writeable")}
 			continue
 		}
 		sl.Info("handling a resize request")
 		t0 := time.Now()
-		origFile, err := os.Open(req.Path)
-		if err != nil {
-			origFile.Close()
-			sl.Err(fmt.Sprintf("resize worker could not open %s: %s", req.Path, err.Error()))
-			req.Response <- ResizeResponse{nil, false, false}
+		result := resizeImage(req.Image, st, sl, s)
+		req.Response <- result
+		if result.Success {
+			t1 := time.Now()
+			sl.Info(fmt.Sprintf("finished resize [%v]", t1.Sub(t0)))
+		}
+	}
+}
+
+// imagemagick stores what it makes itself. A native resize
+// comes back as an OutputImage, for the caller to encode and cache.
+func resizeImage(ri *ImageSpecifier, st Store, sl Logger, s *SiteConfig) ResizeResponse {
+	var err error
+	for _, engine := range resizeEngines(s.ResizeEngine) {
+		if engine == resizeEngineNative && extencoders[ri.Extension] == nil {
+			// only imagemagick can write this format
 			continue
 		}
-		_, err = imageMagickResize(req.Path, req.Size, sl, s)
+		switch engine {
+		case resizeEngineNative:
+			var img image.Image
+			img, err = resizeNative(ri, st, s)
+			if err == nil {
+				return ResizeResponse{&img, true, false, nil}
+			}
+		case resizeEngineImageMagick:
+			err = resizeWithImageMagick(ri, st, sl, s)
+			if err == nil {
+				return ResizeResponse{nil, true, true, nil}
+			}
+		}
+		sl.Warning(fmt.Sprintf("%s couldn't handle %s: %s", engine, ri.String(), err.Error()))
+		if _, tooBig := err.(uploadError); tooBig {
+			// no point asking anything else to decode it
+			break
+		}
+	}
+	sl.Err(fmt.Sprintf("could not resize %s", ri.String()))
+	return ResizeResponse{nil, false, false, err}
+}
+
+func resizeNative(ri *ImageSpecifier, st Store, s *SiteConfig) (image.Image, error) {
+	source, err := originalFor(st, ri)
+	if err != nil {
+		return nil, err
+	}
+	decode, ok := decoders[strings.TrimPrefix(source.Extension, ".")]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("no decoder for %s", source.Extension))
+	}
+	orig, err := readAll(st, source)
+	if err != nil {
+		return nil, err
+	}
+	// limits may have been tightened since this was uploaded
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(orig))
+	if err == nil {
+		err = s.Limits().checkDimensions(cfg)
+	}
+	if err == nil {
+		err = s.Limits().checkFrames(bytes.NewReader(orig), cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var img image.Image
+	if source.Extension == ".gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(orig))
 		if err != nil {
-			// imagemagick couldn't handle it either
-			sl.Err(fmt.Sprintf("imagemagick couldn't handle it: %s", err.Error()))
-			req.Response <- ResizeResponse{nil, false, false}
-		} else {
-			// imagemagick saved the day
-			sl.Info("rescued by imagemagick")
-			req.Response <- ResizeResponse{nil, true, true}
-			t1 := time.Now()
-			sl.Info(fmt.Sprintf("finished resize [%v]", t1.Sub(t0)))
+			return nil, err
+		}
+		if len(g.Image) > 1 && ri.Extension == ".gif" {
+			if ri.Static {
+				// the same, but with only one frame to do
+				g = justFirstFrame(g)
+			}
+			// every frame is resized
+			return resizeAnimation(g, ri.Size), nil
 		}
+		// other formats just get the first one
+		img = firstFrameOf(g)
+	} else {
+		img, err = decode(bytes.NewReader(orig))
+		if err != nil {
+			return nil, err
+		}
+		// has to be the right way up before working out its size,
+		// or portrait photos come out landscape sized
+		img = orient(img, exifOrientation(orig))
 	}
+	img = scaleImage(img, ri.Size)
+	if !keepsTransparency(ri.Extension) {
+		bg, err := parseHexColor(s.FlattenBackground)
+		if err != nil {
+			return nil, err
+		}
+		img = flatten(img, bg)
+	}
+	return img, nil
+}
+
+// convert only deals in files, so the original gets copied out of
+// the store into a temp file, and the result goes back in from one
+func resizeWithImageMagick(ri *ImageSpecifier, st Store, sl Logger, s *SiteConfig) error {
+	source, err := originalFor(st, ri)
+	if err != nil {
+		return err
+	}
+	orig, err := st.Get(source)
+	if err != nil {
+		return err
+	}
+	// convert picks formats by extension, so keep it
+	input, err := ioutil.TempFile("", "reticulum-resize-*"+source.Extension)
+	if err != nil {
+		orig.Close()
+		return err
+	}
+	defer os.Remove(input.Name())
+	_, err = io.Copy(input, orig)
+	orig.Close()
+	if err == nil {
+		_, err = input.Seek(0, 0)
+	}
+	if err != nil {
+		input.Close()
+		return err
+	}
+	// limits may have been tightened since this was uploaded,
+	// so check again before anything decodes the whole thing
+	cfg, _, err := image.DecodeConfig(input)
+	if err == nil {
+		err = s.Limits().checkDimensions(cfg)
+	}
+	if err == nil {
+		_, err = input.Seek(0, 0)
+	}
+	if err == nil {
+		err = s.Limits().checkFrames(input, cfg)
+	}
+	input.Close()
+	if err != nil {
+		return err
+	}
+
+	path := input.Name()
+	if ri.Static {
+		// convert reads just that frame, and never sees
+		// an animation to keep
+		path += "[0]"
+	}
+	output, err := imageMagickResize(path, ri.Size.String(), ri.Extension, sl, s)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(output)
+	f, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return st.Put(ri, f)
 }
 
 // Go's built-in image/jpeg can't load progressive jpegs
 // so sometimes we need to bail and have imagemagick do the work
 // this sucks, is redundant, and i'd rather not have this external dependency
 // so this will be removed as soon as Go can handle it all itself
-func imageMagickResize(path, size string, sl Logger,
+//
+// the output is left in a temp file next to the input, and it's
+// up to the caller to clean it up. ext is the format it's wanted in.
+func imageMagickResize(path, size, ext string, sl Logger,
 	s *SiteConfig) (string, error) {
 
-	args := convertArgs(size, path, s.ImageMagickConvertPath)
+	// that's how convert picks the output format
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-*"+ext)
+	if err != nil {
+		sl.Err("could not create temp file for imagemagick")
+		return "", err
+	}
+	tmp.Close()
 
-	fds := []*os.File{os.Stdin, os.Stdout, os.Stderr}
-	p, err := os.StartProcess(args[0], args, &os.ProcAttr{Files: fds})
-	defer p.Release()
+	args := convertArgs(size, path, tmp.Name(), s.ImageMagickConvertPath, s.FlattenBackground)
+	err = runConvert(args, s, sl, nil)
 	if err != nil {
-		sl.Err("imagemagick failed to start")
-		sl.Err(err.Error())
+		os.Remove(tmp.Name())
 		return "", err
 	}
-	_, err = p.Wait()
+	return tmp.Name(), nil
+}
+
+// runs convert with our limits on it, killing it if it
+// takes too long. Anything it has to say goes to the log,
+// except its output, which goes to stdout if it's wanted.
+func runConvert(args []string, s *SiteConfig, sl Logger, stdout io.Writer) error {
+	timeout := time.Duration(s.ImageMagickTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], append(limitArgs(s), args[1:]...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = stdout
+	err := cmd.Run()
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if line != "" {
+			sl.Warning("imagemagick: " + line)
+		}
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = errors.New(fmt.Sprintf("imagemagick killed after %v", timeout))
+	}
 	if err != nil {
 		sl.Err("imagemagick failed")
 		sl.Err(err.Error())
-		return "", err
 	}
-	return resizedPath(path, size), nil
+	return err
+}
+
+// these go before everything else, so they apply to the
+// whole run. Past them, imagemagick gives up rather than
+// letting one image take over the machine.
+func limitArgs(s *SiteConfig) []string {
+	var args []string
+	if s.ImageMagickMemoryLimit != "" {
+		args = append(args, "-limit", "memory", s.ImageMagickMemoryLimit)
+		// past memory, it goes to memory mapped files
+		// and then disk, which is where things get slow
+		args = append(args, "-limit", "map", s.ImageMagickMemoryLimit)
+	}
+	if s.ImageMagickThreads > 0 {
+		args = append(args, "-limit", "thread", strconv.Itoa(s.ImageMagickThreads))
+	}
+	return args
 }
 
 func resizedPath(path, size string) string {
@@ -95,7 +310,9 @@ func resizedPath(path, size string) string {
 	return d + "/" + size + extension
 }
 
-func convertArgs(size, path, convertBin string) []string {
+// background is what anything transparent is put on, if the
+// output format can't do transparency
+func convertArgs(size, path, output, convertBin, background string) []string {
 	// need to convert our size spec to what convert expects
 	// we can ignore 'full' since that will never trigger
 	// a resize_worker request
@@ -107,33 +324,41 @@ func convertArgs(size, path, convertBin string) []string {
 		maxDim = s.Height()
 	}
 
-	var args []string
+	// convert applies these in order, so reading the image
+	// and turning it the right way up comes before anything
+	// that works out sizes from its width and height
+	input, outputExt := filepath.Ext(path), filepath.Ext(output)
+	animated := input == ".gif" && outputExt == ".gif"
+	if input == ".gif" && !animated {
+		// only gifs stay animated. anything else is
+		// made from the first frame
+		path += "[0]"
+	}
+	args := []string{convertBin, path}
+	if animated {
+		// every frame whole, so they can be resized separately
+		args = append(args, "-coalesce")
+	}
+	args = append(args,
+		"-auto-orient",
+		"-resize",
+		s.ToImageMagickSpec(),
+	)
 	if s.IsSquare() {
-		args = []string{
-			convertBin,
-			"-resize",
-			s.ToImageMagickSpec(),
-			"-auto-orient",
+		args = append(args,
 			"-gravity",
 			"center",
 			"-extent",
 			fmt.Sprintf("%dx%d", maxDim, maxDim),
-			path,
-			resizedPath(path, size),
-		}
-	} else {
-		// BUG(thraxil): this auto orients properly
-		// but doesn't switch width/height in that case
-		// so 90 or 270 degree rotations come out the wrong
-		// size
-		args = []string{
-			convertBin,
-			"-auto-orient",
-			"-resize",
-			s.ToImageMagickSpec(),
-			path,
-			resizedPath(path, size),
-		}
+		)
 	}
-	return args
+	if animated {
+		// otherwise the frames remember where they were
+		// on the original's canvas
+		args = append(args, "+repage")
+	}
+	if !keepsTransparency(outputExt) && background != "" {
+		args = append(args, "-background", background, "-alpha", "remove")
+	}
+	return append(args, output)
 }
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/thraxil/resize"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 type rptestcase struct {
@@ -28,39 +34,106 @@ func Test_resizedPath(t *testing.T) {
 type catestcase struct {
 	Size       string
 	Path       string
+	OutputPath string
 	ConvertBin string
 	Output     []string
 }
 
 func Test_convertArgs(t *testing.T) {
 	var testCases = []catestcase{
-		catestcase{"100s", "/foo/bar/image.jpg", "/usr/bin/convert",
+		catestcase{"100s", "/foo/bar/image.jpg", "/foo/bar/100s.jpg", "/usr/bin/convert",
 			[]string{
 				"/usr/bin/convert",
+				"/foo/bar/image.jpg",
+				"-auto-orient",
 				"-resize",
 				"100x100^",
-				"-auto-orient",
 				"-gravity",
 				"center",
 				"-extent",
 				"100x100",
-				"/foo/bar/image.jpg",
+				"-background",
+				"#ffffff",
+				"-alpha",
+				"remove",
 				"/foo/bar/100s.jpg",
 			},
 		},
-		catestcase{"100w", "/foo/bar/image.jpg", "/usr/bin/convert",
+		catestcase{"100w", "/foo/bar/image.jpg", "/foo/bar/100w.jpg", "/usr/bin/convert",
 			[]string{
 				"/usr/bin/convert",
+				"/foo/bar/image.jpg",
 				"-auto-orient",
 				"-resize",
 				"100",
+				"-background",
+				"#ffffff",
+				"-alpha",
+				"remove",
+				"/foo/bar/100w.jpg",
+			},
+		},
+		catestcase{"100x50", "/foo/bar/image.jpg", "/foo/bar/100x50.jpg", "/usr/bin/convert",
+			[]string{
+				"/usr/bin/convert",
 				"/foo/bar/image.jpg",
+				"-auto-orient",
+				"-resize",
+				"100x50",
+				"-background",
+				"#ffffff",
+				"-alpha",
+				"remove",
+				"/foo/bar/100x50.jpg",
+			},
+		},
+		catestcase{"100w", "/foo/bar/image.png", "/foo/bar/100w.webp", "/usr/bin/convert",
+			[]string{
+				"/usr/bin/convert",
+				"/foo/bar/image.png",
+				"-auto-orient",
+				"-resize",
+				"100",
+				"/foo/bar/100w.webp",
+			},
+		},
+		catestcase{"100w", "/foo/bar/image.gif", "/foo/bar/100w.jpg", "/usr/bin/convert",
+			[]string{
+				"/usr/bin/convert",
+				"/foo/bar/image.gif[0]",
+				"-auto-orient",
+				"-resize",
+				"100",
+				"-background",
+				"#ffffff",
+				"-alpha",
+				"remove",
 				"/foo/bar/100w.jpg",
 			},
 		},
+		catestcase{"100s", "/foo/bar/image.gif", "/foo/bar/100s.gif", "/usr/bin/convert",
+			[]string{
+				"/usr/bin/convert",
+				"/foo/bar/image.gif",
+				"-coalesce",
+				"-auto-orient",
+				"-resize",
+				"100x100^",
+				"-gravity",
+				"center",
+				"-extent",
+				"100x100",
+				"+repage",
+				"/foo/bar/100s.gif",
+			},
+		},
 	}
 	for _, tc := range testCases {
-		output := convertArgs(tc.Size, tc.Path, tc.ConvertBin)
+		output := convertArgs(tc.Size, tc.Path, tc.OutputPath, tc.ConvertBin, "#ffffff")
+		if len(output) != len(tc.Output) {
+			t.Errorf("wrong number of convert args for %s: %v", tc.Size, output)
+			continue
+		}
 		for i := range output {
 			if tc.Output[i] != output[i] {
 				fmt.Printf("%s %s\n", tc.Output[i], output[i])
@@ -69,3 +142,226 @@ func Test_convertArgs(t *testing.T) {
 		}
 	}
 }
+
+func resizeTestStore(t *testing.T, ext string, data []byte) (Store, *ImageSpecifier) {
+	st := NewMemoryStore()
+	img, err := ingestImage(st, bytes.NewReader(data), "", "", ImageLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, &ImageSpecifier{Hash: img.Hash, Size: resize.MakeSizeSpec("10w"), Extension: "." + ext}
+}
+
+func Test_resizeImageNative(t *testing.T) {
+	s := ConfigData{Writeable: true, ImageMagickConvertPath: "/nonexistent/convert"}.MyConfig()
+	for _, ext := range []string{"jpg", "png", "gif"} {
+		st, ri := resizeTestStore(t, ext, encodedTestImage(ext, 30, 20))
+		result := resizeImage(ri, st, DummyLogger{}, &s)
+		if !result.Success || result.Magick || result.OutputImage == nil {
+			t.Errorf("%s should have been resized natively", ext)
+			continue
+		}
+		b := (*result.OutputImage).Bounds()
+		if b.Dx() != 10 || b.Dy() != 6 {
+			t.Errorf("%s came out %dx%d", ext, b.Dx(), b.Dy())
+		}
+	}
+
+	// preferring imagemagick, but it isn't there
+	s.ResizeEngine = resizeEngineImageMagick
+	st, ri := resizeTestStore(t, "png", encodedTestImage("png", 30, 20))
+	if result := resizeImage(ri, st, DummyLogger{}, &s); !result.Success || result.Magick {
+		t.Error("should have fallen back to native")
+	}
+
+	// too big for the limits now: neither engine should try
+	s.MaxImageWidth = 20
+	if result := resizeImage(ri, st, DummyLogger{}, &s); result.Success {
+		t.Error("should have refused an image over the limits")
+	}
+}
+
+func Test_ResizeWorker(t *testing.T) {
+	s := ConfigData{Writeable: true, ImageMagickConvertPath: "/nonexistent/convert"}.MyConfig()
+	st, ri := resizeTestStore(t, "png", encodedTestImage("png", 30, 20))
+	requests := make(chan ResizeRequest)
+	go ResizeWorker(requests, DummyLogger{}, &s, st)
+	defer close(requests)
+
+	c := make(chan ResizeResponse)
+	requests <- ResizeRequest{ri, c}
+	if result := <-c; !result.Success {
+		t.Error("resize failed")
+	}
+
+	// no original to resize from
+	missing, _ := HashFromString("fb682e05b9be61797601e60165825c0b089f755e", "")
+	bad := &ImageSpecifier{Hash: missing, Size: ri.Size, Extension: ".jpg"}
+	requests <- ResizeRequest{bad, c}
+	if result := <-c; result.Success {
+		t.Error("nothing should have been able to resize that")
+	}
+
+	if !knownResizeEngine(s.ResizeEngine) || knownResizeEngine("gimp") {
+		t.Error("wrong resize engines")
+	}
+}
+
+// remembers what it was told
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Info(m string) error    { l.lines = append(l.lines, "INFO "+m); return nil }
+func (l *recordingLogger) Err(m string) error     { l.lines = append(l.lines, "ERR "+m); return nil }
+func (l *recordingLogger) Warning(m string) error { l.lines = append(l.lines, "WARN "+m); return nil }
+
+func (l *recordingLogger) said(s string) bool {
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// a stand-in for convert that runs script, with the
+// input file as $input and the output as $last
+func fakeConvert(t *testing.T, script string) (string, func()) {
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/convert"
+	body := "#!/bin/sh\nfor last; do true; done\n" +
+		"args=\"$*\"\nwhile [ \"$1\" = -limit ]; do shift 3; done\ninput=$1\n" +
+		script + "\n"
+	if err := ioutil.WriteFile(path, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func Test_limitArgs(t *testing.T) {
+	s := ConfigData{}.MyConfig()
+	args := strings.Join(limitArgs(&s), " ")
+	if args != "-limit memory 256MiB -limit map 256MiB -limit thread 1" {
+		t.Errorf("wrong default limits: %s", args)
+	}
+	s = ConfigData{ImageMagickMemoryLimit: "1GiB", ImageMagickThreads: 4}.MyConfig()
+	args = strings.Join(limitArgs(&s), " ")
+	if args != "-limit memory 1GiB -limit map 1GiB -limit thread 4" {
+		t.Errorf("wrong limits: %s", args)
+	}
+}
+
+func Test_runConvert(t *testing.T) {
+	s := ConfigData{ImageMagickTimeout: 1}.MyConfig()
+
+	convert, cleanup := fakeConvert(t, `echo "$args" > "$last"`)
+	defer cleanup()
+	out := convert + ".out"
+	sl := &recordingLogger{}
+	if err := runConvert([]string{convert, "in.jpg", out}, &s, sl, nil); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := ioutil.ReadFile(out)
+	if !strings.HasPrefix(string(written), "-limit memory 256MiB") {
+		t.Errorf("limits should come first: %s", written)
+	}
+
+	convert, cleanup = fakeConvert(t, "echo 'no decode delegate' >&2; exit 1")
+	defer cleanup()
+	sl = &recordingLogger{}
+	if err := runConvert([]string{convert, "in.jpg", out}, &s, sl, nil); err == nil {
+		t.Error("non-zero exit should be a failure")
+	}
+	if !sl.said("WARN imagemagick: no decode delegate") {
+		t.Errorf("stderr should have been logged: %v", sl.lines)
+	}
+
+	convert, cleanup = fakeConvert(t, "exec sleep 10")
+	defer cleanup()
+	sl = &recordingLogger{}
+	t0 := time.Now()
+	err := runConvert([]string{convert, "in.jpg", out}, &s, sl, nil)
+	if err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("should have been killed: %v", err)
+	}
+	if time.Since(t0) > 5*time.Second {
+		t.Error("took far too long to kill")
+	}
+}
+
+func Test_resizeImageFailingImageMagick(t *testing.T) {
+	convert, cleanup := fakeConvert(t, "exit 1")
+	defer cleanup()
+	s := ConfigData{Writeable: true, ImageMagickConvertPath: convert, ResizeEngine: resizeEngineImageMagick}.MyConfig()
+	st, ri := resizeTestStore(t, "png", encodedTestImage("png", 30, 20))
+	result := resizeImage(ri, st, DummyLogger{}, &s)
+	if !result.Success || result.Magick {
+		t.Error("a failed convert should fall back to native")
+	}
+
+	convert, cleanup = fakeConvert(t, `cp "$input" "$last"`)
+	defer cleanup()
+	s.ImageMagickConvertPath = convert
+	result = resizeImage(ri, st, DummyLogger{}, &s)
+	if !result.Success || !result.Magick {
+		t.Error("convert worked, so it should have been used")
+	}
+	if _, err := st.Stat(ri); err != nil {
+		t.Error("imagemagick's output should have been stored")
+	}
+}
+
+// convert dying part way through mustn't leave anything behind
+// that could end up stored as the resized image
+func Test_imageMagickResizeFailure(t *testing.T) {
+	convert, cleanup := fakeConvert(t, `echo partial > "$last"; exit 1`)
+	defer cleanup()
+	s := ConfigData{ImageMagickConvertPath: convert}.MyConfig()
+	dir, err := ioutil.TempDir("", "reticulum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := dir + "/full.png"
+	ioutil.WriteFile(input, encodedTestImage("png", 30, 20), 0644)
+
+	output, err := imageMagickResize(input, "10s", ".png", DummyLogger{}, &s)
+	if err == nil || output != "" {
+		t.Error("a failed convert should be an error")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("convert's output should have been removed: %d files left", len(files))
+	}
+}
+
+func Test_resizeImageWebP(t *testing.T) {
+	convert, cleanup := fakeConvert(t, `echo "$args" > "$last"`)
+	defer cleanup()
+	s := ConfigData{Writeable: true, ImageMagickConvertPath: convert}.MyConfig()
+	st, ri := resizeTestStore(t, "png", encodedTestImage("png", 30, 20))
+	ri.Extension = ".webp"
+
+	result := resizeImage(ri, st, DummyLogger{}, &s)
+	if !result.Success || !result.Magick {
+		t.Fatal("only imagemagick can make webp")
+	}
+	args, err := readAll(st, ri)
+	if err != nil {
+		t.Fatal("webp should have been stored")
+	}
+	fields := strings.Fields(string(args))
+	if !strings.Contains(string(args), ".png -auto-orient") || !strings.HasSuffix(fields[len(fields)-1], ".webp") {
+		t.Errorf("should have converted the png original to webp: %s", args)
+	}
+
+	s.ImageMagickConvertPath = "/nonexistent/convert"
+	ri.Size = resize.MakeSizeSpec("20w")
+	if result := resizeImage(ri, st, DummyLogger{}, &s); result.Success {
+		t.Error("native can't write webp")
+	}
+}